@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/ontio/btcrelayer"
 	"github.com/ontio/btcrelayer/log"
 	"github.com/ontio/btcrelayer/observer"
@@ -34,7 +35,44 @@ func main() {
 	if conf.SleepTime > 0 {
 		observer.SleepTime = time.Duration(conf.SleepTime)
 	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "rescan":
+		if err = rescan(r, flag.Args()[1:]); err != nil {
+			log.Errorf("rescan failed: %v", err)
+		}
+		return
+	case "allia-rescan":
+		if err = alliaRescan(r, flag.Args()[1:]); err != nil {
+			log.Errorf("allia-rescan failed: %v", err)
+		}
+		return
+	case "failed":
+		if err = listFailed(r); err != nil {
+			log.Errorf("failed to list failed deposits: %v", err)
+		}
+		return
+	case "pending":
+		if err = listPending(r); err != nil {
+			log.Errorf("failed to list pending deposits: %v", err)
+		}
+		return
+	case "replay-failed":
+		n, err := r.ReplayFailed()
+		if err != nil {
+			log.Errorf("replay-failed failed: %v", err)
+			return
+		}
+		log.Infof("%d failed deposits put back into relay queue", n)
+		return
+	default:
+		log.Errorf("unknown command %s", flag.Arg(0))
+		return
+	}
+
 	go r.BtcListen()
+	go r.MempoolListen()
 	go r.Relay()
 	go r.AllianceListen()
 	go r.Broadcast()
@@ -42,3 +80,74 @@ func main() {
 
 	select {}
 }
+
+// rescan relays the deposits missed in a range of btc blocks. The relayer must be stopped
+// before, since it holds the retry db.
+func rescan(r *btc_relayer.BtcRelayer, args []string) error {
+	fs := flag.NewFlagSet("rescan", flag.ContinueOnError)
+	from := fs.Uint("from", 0, "first btc height to rescan")
+	to := fs.Uint("to", 0, "last btc height to rescan")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == 0 || *to < *from {
+		return fmt.Errorf("need 0 < from <= to, got from %d to %d", *from, *to)
+	}
+
+	relayed, skipped, err := r.Rescan(uint32(*from), uint32(*to))
+	log.Infof("rescan from %d to %d: %d deposits relayed, %d already imported", *from, *to, relayed, skipped)
+	return err
+}
+
+// alliaRescan broadcasts the withdrawals in a range of alliance blocks again. The relayer must
+// be stopped before, since it holds the retry db.
+func alliaRescan(r *btc_relayer.BtcRelayer, args []string) error {
+	fs := flag.NewFlagSet("allia-rescan", flag.ContinueOnError)
+	from := fs.Uint("from", 0, "first alliance height to rescan")
+	to := fs.Uint("to", 0, "last alliance height to rescan")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == 0 || *to < *from {
+		return fmt.Errorf("need 0 < from <= to, got from %d to %d", *from, *to)
+	}
+
+	queued, skipped, err := r.AlliaRescan(uint32(*from), uint32(*to))
+	log.Infof("allia-rescan from %d to %d: %d withdrawals queued, %d already confirmed", *from, *to, queued,
+		skipped)
+	return err
+}
+
+// listFailed prints the deposits the alliance refused to import. The relayer must be stopped
+// before, since it holds the retry db.
+func listFailed(r *btc_relayer.BtcRelayer) error {
+	failed, err := r.FailedDeposits()
+	if err != nil {
+		return err
+	}
+	for _, d := range failed {
+		fmt.Printf("%s\theight %d\tfailed at %s\t%s\n", d.Txid, d.Height,
+			time.Unix(d.FailedAt, 0).Format(time.RFC3339), d.Reason)
+	}
+	log.Infof("%d failed deposits", len(failed))
+	return nil
+}
+
+// listPending prints the deposits seen in the mempool, with the height they're confirmed at if
+// any. The relayer must be stopped before, since it holds the retry db.
+func listPending(r *btc_relayer.BtcRelayer) error {
+	pending, err := r.PendingDeposits()
+	if err != nil {
+		return err
+	}
+	for _, d := range pending {
+		confirmed := "unconfirmed"
+		if d.Confirmed() {
+			confirmed = fmt.Sprintf("height %d", d.Height)
+		}
+		fmt.Printf("%s\tfirst seen at %s\t%s\n", d.Txid, time.Unix(d.FirstSeen, 0).Format(time.RFC3339),
+			confirmed)
+	}
+	log.Infof("%d pending deposits", len(pending))
+	return nil
+}
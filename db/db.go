@@ -1,8 +1,10 @@
 package db
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
@@ -10,12 +12,26 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
 	BKTRetry           = []byte("retry")
 	BKTBtcLastHeight   = []byte("btclast")
 	BKTAlliaLastHeight = []byte("allialast")
+	BKTBtcBlockHash    = []byte("btchash")
+	BKTBtcDeposits     = []byte("btcdeposits")
+	BKTBtcOrphaned     = []byte("btcorphaned")
+	BKTBtcRejected     = []byte("btcrejected")
+	BKTBtcPending      = []byte("btcpending")
+	BKTBtcHeader       = []byte("btcheader")
+	BKTAlliaOutbox     = []byte("alliaoutbox")
+	BKTAlliaQuarantine = []byte("alliaquarantine")
+	BKTAlliaPsbt       = []byte("alliapsbt")
+	BKTBtcRelayQueue   = []byte("btcrelayqueue")
+	BKTBtcImported     = []byte("btcimported")
+	BKTBtcFailed       = []byte("btcfailed")
+	BKTBtcUtxo         = []byte("btcutxo")
 	KEYBtcLastHeight   = []byte("btclast")
 	KEYAlliaLastHeight = []byte("allialast")
 )
@@ -70,6 +86,71 @@ func NewRetryDB(filePath string, times, retryDuration int, maxReadSize uint64) (
 			return err
 		}
 
+		_, err = btx.CreateBucketIfNotExists(BKTBtcBlockHash)
+		if err != nil {
+			return err
+		}
+
+		_, err = btx.CreateBucketIfNotExists(BKTBtcDeposits)
+		if err != nil {
+			return err
+		}
+
+		_, err = btx.CreateBucketIfNotExists(BKTBtcOrphaned)
+		if err != nil {
+			return err
+		}
+
+		_, err = btx.CreateBucketIfNotExists(BKTBtcRejected)
+		if err != nil {
+			return err
+		}
+
+		_, err = btx.CreateBucketIfNotExists(BKTBtcPending)
+		if err != nil {
+			return err
+		}
+
+		_, err = btx.CreateBucketIfNotExists(BKTBtcHeader)
+		if err != nil {
+			return err
+		}
+
+		_, err = btx.CreateBucketIfNotExists(BKTAlliaOutbox)
+		if err != nil {
+			return err
+		}
+
+		_, err = btx.CreateBucketIfNotExists(BKTAlliaQuarantine)
+		if err != nil {
+			return err
+		}
+
+		_, err = btx.CreateBucketIfNotExists(BKTAlliaPsbt)
+		if err != nil {
+			return err
+		}
+
+		_, err = btx.CreateBucketIfNotExists(BKTBtcRelayQueue)
+		if err != nil {
+			return err
+		}
+
+		_, err = btx.CreateBucketIfNotExists(BKTBtcImported)
+		if err != nil {
+			return err
+		}
+
+		_, err = btx.CreateBucketIfNotExists(BKTBtcFailed)
+		if err != nil {
+			return err
+		}
+
+		_, err = btx.CreateBucketIfNotExists(BKTBtcUtxo)
+		if err != nil {
+			return err
+		}
+
 		return nil
 	}); err != nil {
 		return nil, err
@@ -128,6 +209,825 @@ func (r *RetryDB) GetAlliaHeight() uint32 {
 	return r.getHeight(BKTAlliaLastHeight, KEYAlliaLastHeight)
 }
 
+type OutboxItem struct {
+	Key []byte
+	Tx  string
+}
+
+// CommitAlliaBlock puts the txs captured in the alliance block at height into the outbox and
+// moves the alliance cursor to height in one transaction. The keys of the txs in the outbox
+// are returned in order.
+func (r *RetryDB) CommitAlliaBlock(height uint32, txs []string) ([][]byte, error) {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	keys := make([][]byte, 0, len(txs))
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(BKTAlliaOutbox)
+		for i, t := range txs {
+			k := make([]byte, 8)
+			binary.BigEndian.PutUint32(k, height)
+			binary.BigEndian.PutUint32(k[4:], uint32(i))
+			if err := outbox.Put(k, []byte(t)); err != nil {
+				return err
+			}
+			keys = append(keys, k)
+		}
+
+		val := make([]byte, 4)
+		binary.LittleEndian.PutUint32(val, height)
+		return tx.Bucket(BKTAlliaLastHeight).Put(KEYAlliaLastHeight, val)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetAlliaOutbox returns the txs in the outbox in the order they were captured.
+func (r *RetryDB) GetAlliaOutbox() ([]*OutboxItem, error) {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+
+	res := make([]*OutboxItem, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BKTAlliaOutbox).ForEach(func(k, v []byte) error {
+			res = append(res, &OutboxItem{
+				Key: append([]byte{}, k...),
+				Tx:  string(v),
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (r *RetryDB) DelAlliaOutbox(key []byte) error {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BKTAlliaOutbox).Delete(key)
+	})
+}
+
+// QuarantinedWithdrawal is a malformed withdrawal notify, States is the states of the notify
+// in json.
+type QuarantinedWithdrawal struct {
+	Height        uint32 `json:"height"`
+	Index         uint32 `json:"index"`
+	States        string `json:"states"`
+	Reason        string `json:"reason"`
+	QuarantinedAt int64  `json:"quarantined_at"`
+}
+
+// PutQuarantinedWithdrawal records q by its height and index in the block, so capturing the
+// same block again doesn't add duplicates.
+func (r *RetryDB) PutQuarantinedWithdrawal(q *QuarantinedWithdrawal) error {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	val, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint32(k, q.Height)
+	binary.BigEndian.PutUint32(k[4:], q.Index)
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BKTAlliaQuarantine).Put(k, val)
+	})
+}
+
+func (r *RetryDB) GetQuarantinedWithdrawals() ([]*QuarantinedWithdrawal, error) {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+
+	res := make([]*QuarantinedWithdrawal, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BKTAlliaQuarantine).ForEach(func(k, v []byte) error {
+			q := &QuarantinedWithdrawal{}
+			if err := json.Unmarshal(v, q); err != nil {
+				return fmt.Errorf("failed to unmarshal quarantined withdrawal %x: %v", k, err)
+			}
+			res = append(res, q)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// PartialWithdrawal is a withdrawal collecting signatures of the federation, Psbt is the
+// serialized PSBT with the signatures collected so far. Once the threshold is met, CompletedAt
+// and CompletedIndex locate the notify that completed it.
+type PartialWithdrawal struct {
+	Txid           string `json:"txid"`
+	Psbt           []byte `json:"psbt"`
+	CompletedAt    uint32 `json:"completed_at"`
+	CompletedIndex uint32 `json:"completed_index"`
+}
+
+func (w *PartialWithdrawal) Completed() bool {
+	return w.CompletedAt > 0
+}
+
+func (r *RetryDB) PutPartialWithdrawal(w *PartialWithdrawal) error {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	val, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BKTAlliaPsbt).Put([]byte(w.Txid), val)
+	})
+}
+
+// GetPartialWithdrawal returns nil if no signature of the withdrawal with txid is collected.
+func (r *RetryDB) GetPartialWithdrawal(txid string) (*PartialWithdrawal, error) {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+
+	var w *PartialWithdrawal
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(BKTAlliaPsbt).Get([]byte(txid))
+		if v == nil {
+			return nil
+		}
+		w = &PartialWithdrawal{}
+		return json.Unmarshal(v, w)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func heightKey(height uint32) []byte {
+	k := make([]byte, 4)
+	binary.BigEndian.PutUint32(k, height)
+	return k
+}
+
+func (r *RetryDB) SetBtcBlockHash(height uint32, hash string) error {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BKTBtcBlockHash).Put(heightKey(height), []byte(hash))
+	})
+}
+
+func (r *RetryDB) GetBtcBlockHash(height uint32) string {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+	var hash string
+	r.db.View(func(tx *bolt.Tx) error {
+		hash = string(tx.Bucket(BKTBtcBlockHash).Get(heightKey(height)))
+		return nil
+	})
+
+	return hash
+}
+
+// PutBtcHeaders stores the serialized block headers from height start onward.
+func (r *RetryDB) PutBtcHeaders(start uint32, headers [][]byte) error {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	return r.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BKTBtcHeader)
+		for i, header := range headers {
+			if err := bucket.Put(heightKey(start+uint32(i)), header); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *RetryDB) GetBtcHeader(height uint32) []byte {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+	var header []byte
+	r.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(BKTBtcHeader).Get(heightKey(height)); v != nil {
+			header = make([]byte, len(v))
+			copy(header, v)
+		}
+		return nil
+	})
+
+	return header
+}
+
+// QueuedDeposit is a deposit waiting to be imported to the alliance.
+type QueuedDeposit struct {
+	Key    []byte `json:"-"`
+	Txid   string `json:"txid"`
+	Tx     []byte `json:"tx"`
+	Proof  []byte `json:"proof"`
+	Height uint32 `json:"height"`
+}
+
+// CommitBtcBlock records the block at height with its deposits, puts the deposits into the
+// relay queue and moves the btc cursor to top, all in one transaction. The keys of the
+// deposits in the queue are returned in order.
+func (r *RetryDB) CommitBtcBlock(height uint32, hash string, top uint32, deposits []*QueuedDeposit) ([][]byte, error) {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	keys := make([][]byte, 0, len(deposits))
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket(BKTBtcRelayQueue)
+		for i, d := range deposits {
+			k := make([]byte, 8)
+			binary.BigEndian.PutUint32(k, height)
+			binary.BigEndian.PutUint32(k[4:], uint32(i))
+			val, err := json.Marshal(d)
+			if err != nil {
+				return err
+			}
+			if err = queue.Put(k, val); err != nil {
+				return err
+			}
+			if err = tx.Bucket(BKTBtcDeposits).Put(append(heightKey(height), []byte(d.Txid)...), []byte{}); err != nil {
+				return err
+			}
+			keys = append(keys, k)
+		}
+		if err := tx.Bucket(BKTBtcBlockHash).Put(heightKey(height), []byte(hash)); err != nil {
+			return err
+		}
+
+		val := make([]byte, 4)
+		binary.LittleEndian.PutUint32(val, top)
+		return tx.Bucket(BKTBtcLastHeight).Put(KEYBtcLastHeight, val)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetRelayQueue returns the deposits in the relay queue in the order they were found.
+func (r *RetryDB) GetRelayQueue() ([]*QueuedDeposit, error) {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+
+	res := make([]*QueuedDeposit, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BKTBtcRelayQueue).ForEach(func(k, v []byte) error {
+			d := &QueuedDeposit{}
+			if err := json.Unmarshal(v, d); err != nil {
+				return fmt.Errorf("failed to unmarshal queued deposit %x: %v", k, err)
+			}
+			d.Key = append([]byte{}, k...)
+			res = append(res, d)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// InRelayQueue tells if the deposit txid is still in the relay queue under key. It's dropped
+// when its block is orphaned, and the key may be taken by a deposit of the new block.
+func (r *RetryDB) InRelayQueue(key []byte, txid string) (bool, error) {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+
+	in := false
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(BKTBtcRelayQueue).Get(key)
+		if v == nil {
+			return nil
+		}
+		d := &QueuedDeposit{}
+		if err := json.Unmarshal(v, d); err != nil {
+			return fmt.Errorf("failed to unmarshal queued deposit %x: %v", key, err)
+		}
+		in = d.Txid == txid
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return in, nil
+}
+
+func (r *RetryDB) DelRelayQueue(key []byte) error {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BKTBtcRelayQueue).Delete(key)
+	})
+}
+
+// FailedDeposit is a deposit the alliance refused to import. It's kept under its key in the
+// relay queue until an operator replays it.
+type FailedDeposit struct {
+	QueuedDeposit
+	Reason   string `json:"reason"`
+	FailedAt int64  `json:"failed_at"`
+}
+
+// FailRelayQueue moves the deposit with key from the relay queue to the failed deposits.
+func (r *RetryDB) FailRelayQueue(key []byte, reason string) error {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	return r.db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket(BKTBtcRelayQueue)
+		v := queue.Get(key)
+		if v == nil {
+			return nil
+		}
+		d := &FailedDeposit{
+			Reason:   reason,
+			FailedAt: time.Now().Unix(),
+		}
+		if err := json.Unmarshal(v, &d.QueuedDeposit); err != nil {
+			return fmt.Errorf("failed to unmarshal queued deposit %x: %v", key, err)
+		}
+		val, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		if err = tx.Bucket(BKTBtcFailed).Put(key, val); err != nil {
+			return err
+		}
+		return queue.Delete(key)
+	})
+}
+
+func (r *RetryDB) GetFailedDeposits() ([]*FailedDeposit, error) {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+
+	res := make([]*FailedDeposit, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BKTBtcFailed).ForEach(func(k, v []byte) error {
+			d := &FailedDeposit{}
+			if err := json.Unmarshal(v, d); err != nil {
+				return fmt.Errorf("failed to unmarshal failed deposit %x: %v", k, err)
+			}
+			d.Key = append([]byte{}, k...)
+			res = append(res, d)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// ReplayFailedDeposits moves every failed deposit back to the relay queue, and returns how
+// many are moved.
+func (r *RetryDB) ReplayFailedDeposits() (int, error) {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	n := 0
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		failed := tx.Bucket(BKTBtcFailed)
+		queue := tx.Bucket(BKTBtcRelayQueue)
+		c := failed.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.First() {
+			d := &FailedDeposit{}
+			if err := json.Unmarshal(v, d); err != nil {
+				return fmt.Errorf("failed to unmarshal failed deposit %x: %v", k, err)
+			}
+			val, err := json.Marshal(&d.QueuedDeposit)
+			if err != nil {
+				return err
+			}
+			if err = queue.Put(k, val); err != nil {
+				return err
+			}
+			if err = failed.Delete(k); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// ImportedDeposit is a deposit known to be imported to the alliance. AllianceTxHash is empty
+// if it was found imported on chain rather than by us.
+type ImportedDeposit struct {
+	Txid           string `json:"txid"`
+	AllianceTxHash string `json:"alliance_tx_hash"`
+	Height         uint32 `json:"height"`
+	ImportedAt     int64  `json:"imported_at"`
+}
+
+func (r *RetryDB) PutImportedDeposit(d *ImportedDeposit) error {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	val, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BKTBtcImported).Put([]byte(d.Txid), val)
+	})
+}
+
+// GetImportedDeposit returns nil if the deposit with txid is not known to be imported.
+func (r *RetryDB) GetImportedDeposit(txid string) (*ImportedDeposit, error) {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+
+	var d *ImportedDeposit
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(BKTBtcImported).Get([]byte(txid))
+		if v == nil {
+			return nil
+		}
+		d = &ImportedDeposit{}
+		return json.Unmarshal(v, d)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (r *RetryDB) PutBtcDeposit(height uint32, txid string) error {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BKTBtcDeposits).Put(append(heightKey(height), []byte(txid)...), []byte{})
+	})
+}
+
+func (r *RetryDB) GetBtcDeposits(height uint32) []string {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+	txids := make([]string, 0)
+	r.db.View(func(tx *bolt.Tx) error {
+		prefix := heightKey(height)
+		c := tx.Bucket(BKTBtcDeposits).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			txids = append(txids, string(k[4:]))
+		}
+		return nil
+	})
+
+	return txids
+}
+
+type OrphanedDeposit struct {
+	Txid       string `json:"txid"`
+	Height     uint32 `json:"height"`
+	BlockHash  string `json:"block_hash"`
+	DetectedAt int64  `json:"detected_at"`
+}
+
+// RollbackBtcBlocks forgets every block and header above fork, moves the deposits relayed from those blocks
+// into the orphaned bucket, drops them from the relay queue and resets the btc cursor to newTop, all in one
+// transaction.
+func (r *RetryDB) RollbackBtcBlocks(fork, newTop uint32) ([]*OrphanedDeposit, error) {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	orphaned := make([]*OrphanedDeposit, 0)
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		hashes := tx.Bucket(BKTBtcBlockHash)
+		deposits := tx.Bucket(BKTBtcDeposits)
+		orphans := tx.Bucket(BKTBtcOrphaned)
+
+		now := time.Now().Unix()
+		start := heightKey(fork + 1)
+		dc := deposits.Cursor()
+		for k, _ := dc.Seek(start); k != nil; k, _ = dc.Seek(start) {
+			height := binary.BigEndian.Uint32(k[:4])
+			o := &OrphanedDeposit{
+				Txid:       string(k[4:]),
+				Height:     height,
+				BlockHash:  string(hashes.Get(k[:4])),
+				DetectedAt: now,
+			}
+			val, err := json.Marshal(o)
+			if err != nil {
+				return err
+			}
+			if err = orphans.Put([]byte(o.Txid), val); err != nil {
+				return err
+			}
+			if err = deposits.Delete(k); err != nil {
+				return err
+			}
+			orphaned = append(orphaned, o)
+		}
+
+		for _, bucket := range []*bolt.Bucket{hashes, tx.Bucket(BKTBtcHeader), tx.Bucket(BKTBtcRelayQueue)} {
+			c := bucket.Cursor()
+			for k, _ := c.Seek(start); k != nil; k, _ = c.Seek(start) {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+
+		val := make([]byte, 4)
+		binary.LittleEndian.PutUint32(val, newTop)
+		return tx.Bucket(BKTBtcLastHeight).Put(KEYBtcLastHeight, val)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return orphaned, nil
+}
+
+func (r *RetryDB) GetOrphanedDeposits() ([]*OrphanedDeposit, error) {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+
+	res := make([]*OrphanedDeposit, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BKTBtcOrphaned).ForEach(func(k, v []byte) error {
+			o := &OrphanedDeposit{}
+			if err := json.Unmarshal(v, o); err != nil {
+				return fmt.Errorf("failed to unmarshal orphaned deposit %s: %v", k, err)
+			}
+			res = append(res, o)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+type RejectedDeposit struct {
+	Txid       string `json:"txid"`
+	Height     uint32 `json:"height"`
+	Reason     string `json:"reason"`
+	RejectedAt int64  `json:"rejected_at"`
+}
+
+func (r *RetryDB) PutRejectedDeposit(d *RejectedDeposit) error {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	val, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BKTBtcRejected).Put([]byte(d.Txid), val)
+	})
+}
+
+func (r *RetryDB) GetRejectedDeposits() ([]*RejectedDeposit, error) {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+
+	res := make([]*RejectedDeposit, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BKTBtcRejected).ForEach(func(k, v []byte) error {
+			d := &RejectedDeposit{}
+			if err := json.Unmarshal(v, d); err != nil {
+				return fmt.Errorf("failed to unmarshal rejected deposit %s: %v", k, err)
+			}
+			res = append(res, d)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// FederationUtxo is an output paying to the federation, found in a block scanned by the observer.
+// Withdrawals spending it are checked with it, since a node without -txindex can't find
+// confirmed txs.
+type FederationUtxo struct {
+	Txid     string `json:"txid"`
+	Index    uint32 `json:"index"`
+	PkScript []byte `json:"pk_script"`
+	Value    int64  `json:"value"`
+	Height   uint32 `json:"height"`
+}
+
+func utxoKey(txid string, index uint32) []byte {
+	return []byte(fmt.Sprintf("%s:%d", txid, index))
+}
+
+func (r *RetryDB) PutFederationUtxos(utxos []*FederationUtxo) error {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	return r.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BKTBtcUtxo)
+		for _, u := range utxos {
+			val, err := json.Marshal(u)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put(utxoKey(u.Txid, u.Index), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetFederationUtxo returns nil if output index of txid is not known.
+func (r *RetryDB) GetFederationUtxo(txid string, index uint32) (*FederationUtxo, error) {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+
+	var u *FederationUtxo
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(BKTBtcUtxo).Get(utxoKey(txid, index))
+		if v == nil {
+			return nil
+		}
+		u = &FederationUtxo{}
+		return json.Unmarshal(v, u)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// PendingDeposit is a deposit seen in the mempool. Height and ConfirmedAt are set once the
+// deposit is found in a block by the observer.
+type PendingDeposit struct {
+	Txid        string `json:"txid"`
+	Value       int64  `json:"value"`
+	FirstSeen   int64  `json:"first_seen"`
+	Height      uint32 `json:"height"`
+	ConfirmedAt int64  `json:"confirmed_at"`
+}
+
+func (d *PendingDeposit) Confirmed() bool {
+	return d.ConfirmedAt > 0
+}
+
+// PutPendingDeposit records a deposit from the mempool, and keeps the record untouched if
+// the deposit has been seen before.
+func (r *RetryDB) PutPendingDeposit(d *PendingDeposit) error {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	val, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BKTBtcPending)
+		if bucket.Get([]byte(d.Txid)) != nil {
+			return nil
+		}
+		return bucket.Put([]byte(d.Txid), val)
+	})
+}
+
+// ConfirmPendingDeposit marks a pending deposit as confirmed at height. Deposits never seen in
+// the mempool are ignored.
+func (r *RetryDB) ConfirmPendingDeposit(txid string, height uint32) error {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	return r.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BKTBtcPending)
+		v := bucket.Get([]byte(txid))
+		if v == nil {
+			return nil
+		}
+		d := &PendingDeposit{}
+		if err := json.Unmarshal(v, d); err != nil {
+			return fmt.Errorf("failed to unmarshal pending deposit %s: %v", txid, err)
+		}
+		d.Height = height
+		d.ConfirmedAt = time.Now().Unix()
+		val, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(txid), val)
+	})
+}
+
+func (r *RetryDB) GetPendingDeposit(txid string) (*PendingDeposit, error) {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+
+	var d *PendingDeposit
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(BKTBtcPending).Get([]byte(txid))
+		if v == nil {
+			return nil
+		}
+		d = &PendingDeposit{}
+		return json.Unmarshal(v, d)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// PrunePendingDeposits deletes the pending deposits first seen before expiry, confirmed or not,
+// and returns how many are deleted.
+func (r *RetryDB) PrunePendingDeposits(expiry int64) (int, error) {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+
+	n := 0
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BKTBtcPending)
+		expired := make([][]byte, 0)
+		err := bucket.ForEach(func(k, v []byte) error {
+			d := &PendingDeposit{}
+			if err := json.Unmarshal(v, d); err != nil {
+				return fmt.Errorf("failed to unmarshal pending deposit %s: %v", k, err)
+			}
+			if d.FirstSeen < expiry {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err = bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (r *RetryDB) GetPendingDeposits() ([]*PendingDeposit, error) {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+
+	res := make([]*PendingDeposit, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BKTBtcPending).ForEach(func(k, v []byte) error {
+			d := &PendingDeposit{}
+			if err := json.Unmarshal(v, d); err != nil {
+				return fmt.Errorf("failed to unmarshal pending deposit %s: %v", k, err)
+			}
+			res = append(res, d)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
 func (r *RetryDB) Put(tx string) error {
 	r.rwlock.Lock()
 	defer r.rwlock.Unlock()
@@ -1,6 +1,8 @@
 package db
 
 import (
+	"bytes"
+	"fmt"
 	"os"
 	"testing"
 )
@@ -124,3 +126,148 @@ func TestRetryDB_GetBtcHeight(t *testing.T) {
 func TestOverReadSizeErr_Error(t *testing.T) {
 
 }
+
+func TestRetryDB_RollbackBtcBlocks(t *testing.T) {
+	defer afterTest()
+	db, _ := NewRetryDB("./", 5, 1, 500)
+	for h := uint32(10); h <= 13; h++ {
+		db.SetBtcBlockHash(h, fmt.Sprintf("hash%d", h))
+	}
+	db.PutBtcDeposit(11, "tx11")
+	db.PutBtcDeposit(12, "tx12a")
+	db.PutBtcDeposit(12, "tx12b")
+	db.PutBtcDeposit(13, "tx13")
+
+	orphaned, err := db.RollbackBtcBlocks(11, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphaned) != 3 {
+		t.Fatalf("not right length 3: %d", len(orphaned))
+	}
+	if orphaned[0].Txid != "tx12a" || orphaned[0].BlockHash != "hash12" || orphaned[2].Height != 13 {
+		t.Fatal("not right orphaned deposit")
+	}
+	if db.GetBtcHeight() != 16 {
+		t.Fatal("btc height not reset")
+	}
+	if db.GetBtcBlockHash(11) != "hash11" || db.GetBtcBlockHash(12) != "" {
+		t.Fatal("block hash not right")
+	}
+	if len(db.GetBtcDeposits(11)) != 1 || len(db.GetBtcDeposits(12)) != 0 {
+		t.Fatal("deposits not right")
+	}
+
+	all, err := db.GetOrphanedDeposits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Fatal("not right length 3")
+	}
+}
+
+func TestRetryDB_CommitAlliaBlock(t *testing.T) {
+	defer afterTest()
+	db, _ := NewRetryDB("./", 5, 1, 500)
+	db.SetBtcHeight(100)
+	if _, err := db.CommitAlliaBlock(7, []string{"aa", "bb"}); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := db.CommitAlliaBlock(8, []string{"cc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.GetAlliaHeight() != 8 || db.GetBtcHeight() != 100 {
+		t.Fatal("cursors not right")
+	}
+	if err = db.DelAlliaOutbox(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	items, err := db.GetAlliaOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Tx != "aa" || items[1].Tx != "bb" {
+		t.Fatal("outbox not right")
+	}
+}
+
+func TestRetryDB_CommitBtcBlock(t *testing.T) {
+	defer afterTest()
+	db, _ := NewRetryDB("./", 5, 1, 500)
+	if _, err := db.CommitBtcBlock(10, "hash10", 10, []*QueuedDeposit{{Txid: "tx10", Height: 10}}); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := db.CommitBtcBlock(11, "hash11", 11, []*QueuedDeposit{
+		{Txid: "tx11a", Height: 11},
+		{Txid: "tx11b", Height: 11},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.GetBtcHeight() != 11 || db.GetBtcBlockHash(11) != "hash11" || len(db.GetBtcDeposits(11)) != 2 {
+		t.Fatal("block not committed")
+	}
+	if err = db.DelRelayQueue(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	queued, err := db.GetRelayQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 2 || queued[0].Txid != "tx10" || queued[1].Txid != "tx11b" {
+		t.Fatal("queue not right")
+	}
+
+	if ok, _ := db.InRelayQueue(keys[1], "tx11b"); !ok {
+		t.Fatal("tx11b should be in queue")
+	}
+	if ok, _ := db.InRelayQueue(keys[1], "tx11a"); ok {
+		t.Fatal("key holds tx11b, not tx11a")
+	}
+
+	if _, err = db.RollbackBtcBlocks(10, 10); err != nil {
+		t.Fatal(err)
+	}
+	if queued, _ = db.GetRelayQueue(); len(queued) != 1 || queued[0].Txid != "tx10" {
+		t.Fatal("orphaned deposits should be dropped from queue")
+	}
+	if ok, _ := db.InRelayQueue(keys[1], "tx11b"); ok {
+		t.Fatal("tx11b should have left the queue")
+	}
+}
+
+func TestRetryDB_FailRelayQueue(t *testing.T) {
+	defer afterTest()
+	db, _ := NewRetryDB("./", 5, 1, 500)
+	keys, err := db.CommitBtcBlock(10, "hash10", 10, []*QueuedDeposit{{Txid: "tx10", Height: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.FailRelayQueue(keys[0], "refused"); err != nil {
+		t.Fatal(err)
+	}
+	if queued, _ := db.GetRelayQueue(); len(queued) != 0 {
+		t.Fatal("failed deposit should leave the queue")
+	}
+	failed, err := db.GetFailedDeposits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].Txid != "tx10" || failed[0].Reason != "refused" ||
+		!bytes.Equal(failed[0].Key, keys[0]) {
+		t.Fatal("failed deposits not right")
+	}
+
+	if n, err := db.ReplayFailedDeposits(); err != nil || n != 1 {
+		t.Fatalf("should replay 1 deposit, got %d: %v", n, err)
+	}
+	if failed, _ = db.GetFailedDeposits(); len(failed) != 0 {
+		t.Fatal("replayed deposit should leave the failed ones")
+	}
+	if queued, _ := db.GetRelayQueue(); len(queued) != 1 || queued[0].Txid != "tx10" ||
+		!bytes.Equal(queued[0].Key, keys[0]) {
+		t.Fatal("replayed deposit should be back in queue")
+	}
+}
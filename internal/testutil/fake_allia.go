@@ -0,0 +1,185 @@
+package testutil
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/ontio/btcrelayer/observer"
+	sdk "github.com/ontio/multi-chain-go-sdk"
+	"github.com/ontio/multi-chain-go-sdk/client"
+	sdkcom "github.com/ontio/multi-chain-go-sdk/common"
+	"github.com/ontio/multi-chain/common"
+	"github.com/ontio/multi-chain/native/service/utils"
+	"sync"
+)
+
+type ImportedTransfer struct {
+	TxHash common.Uint256
+	Txid   []byte
+	Tx     []byte
+	Height uint32
+	Proof  []byte
+}
+
+// FakeAllianceChain is an in-memory alliance chain used to test the observers and relayer offline.
+type FakeAllianceChain struct {
+	lock     sync.Mutex
+	height   uint32
+	events   map[uint32][]*sdkcom.SmartContactEvent
+	imported []*ImportedTransfer
+	failures map[string][]error
+	pending  bool
+}
+
+func NewFakeAllianceChain() *FakeAllianceChain {
+	return &FakeAllianceChain{
+		events:   make(map[uint32][]*sdkcom.SmartContactEvent),
+		imported: make([]*ImportedTransfer, 0),
+		failures: make(map[string][]error),
+	}
+}
+
+// Fail makes the next `times` calls of method return err.
+func (chain *FakeAllianceChain) Fail(method string, times int, err error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	for i := 0; i < times; i++ {
+		chain.failures[method] = append(chain.failures[method], err)
+	}
+}
+
+// FailPost makes the next `times` calls of method fail like an unreachable node.
+func (chain *FakeAllianceChain) FailPost(method string, times int) {
+	chain.Fail(method, times, client.PostErr{Err: fmt.Errorf("connection refused")})
+}
+
+func (chain *FakeAllianceChain) popFailure(method string) error {
+	errs := chain.failures[method]
+	if len(errs) == 0 {
+		return nil
+	}
+	chain.failures[method] = errs[1:]
+	return errs[0]
+}
+
+func (chain *FakeAllianceChain) SetHeight(height uint32) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	chain.height = height
+}
+
+// EmitNotify adds a notify with states emitted by contract at height, and raises the chain
+// height if needed.
+func (chain *FakeAllianceChain) EmitNotify(height uint32, contract string, states ...interface{}) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	chain.events[height] = append(chain.events[height], &sdkcom.SmartContactEvent{
+		State: 1,
+		Notify: []*sdkcom.NotifyEventInfo{
+			{
+				ContractAddress: contract,
+				States:          states,
+			},
+		},
+	})
+	if height > chain.height {
+		chain.height = height
+	}
+}
+
+func (chain *FakeAllianceChain) EmitWithdrawal(height uint32, tx string) {
+	chain.EmitNotify(height, utils.CrossChainManagerContractAddress.ToHexString(), "btcTxToRelay", tx)
+}
+
+// SetPending keeps the imports unconfirmed, GetSmartContractEvent finds nothing for them until
+// it's unset.
+func (chain *FakeAllianceChain) SetPending(pending bool) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	chain.pending = pending
+}
+
+func (chain *FakeAllianceChain) Imported() []*ImportedTransfer {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	return append([]*ImportedTransfer{}, chain.imported...)
+}
+
+func (chain *FakeAllianceChain) GetCurrentBlockHeight() (uint32, error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	if err := chain.popFailure("GetCurrentBlockHeight"); err != nil {
+		return 0, err
+	}
+	return chain.height, nil
+}
+
+func (chain *FakeAllianceChain) GetSmartContractEventByBlock(height uint32) ([]*sdkcom.SmartContactEvent, error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	if err := chain.popFailure("GetSmartContractEventByBlock"); err != nil {
+		return nil, err
+	}
+	if height > chain.height {
+		return nil, fmt.Errorf("height %d is above current height %d", height, chain.height)
+	}
+	return chain.events[height], nil
+}
+
+func (chain *FakeAllianceChain) ImportOuterTransfer(sourceChainId uint64, txid []byte, tx []byte, height uint32,
+	proof []byte, relayer []byte, signer *sdk.Account) (common.Uint256, error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	if err := chain.popFailure("ImportOuterTransfer"); err != nil {
+		return common.Uint256{}, err
+	}
+	hash := common.Uint256(sha256.Sum256(append(append([]byte{}, txid...), tx...)))
+	chain.imported = append(chain.imported, &ImportedTransfer{
+		TxHash: hash,
+		Txid:   txid,
+		Tx:     tx,
+		Height: height,
+		Proof:  proof,
+	})
+	return hash, nil
+}
+
+// GetSmartContractEvent only knows the events of imports.
+func (chain *FakeAllianceChain) GetSmartContractEvent(txHash string) (*sdkcom.SmartContactEvent, error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	if err := chain.popFailure("GetSmartContractEvent"); err != nil {
+		return nil, err
+	}
+	if chain.pending {
+		return nil, nil
+	}
+	for _, t := range chain.imported {
+		if t.TxHash.ToHexString() == txHash {
+			return &sdkcom.SmartContactEvent{
+				TxHash: txHash,
+				State:  1,
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetStorage only knows the marks of imported btc txs.
+func (chain *FakeAllianceChain) GetStorage(contractAddress string, key []byte) ([]byte, error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	if err := chain.popFailure("GetStorage"); err != nil {
+		return nil, err
+	}
+	if contractAddress != utils.CrossChainManagerContractAddress.ToHexString() ||
+		!bytes.HasPrefix(key, []byte(observer.BTC_TX_PREFIX)) {
+		return nil, nil
+	}
+	for _, t := range chain.imported {
+		if bytes.Equal(t.Txid, key[len(observer.BTC_TX_PREFIX):]) {
+			return []byte{1}, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,434 @@
+package testutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/ontio/btcrelayer/observer"
+	"github.com/ontio/multi-chain/native/service/cross_chain_manager/btc"
+	"sync"
+	"time"
+)
+
+// FakeBtcChain is an in-memory bitcoind used to test the observer and relayer offline.
+// Blocks are mined on demand at the minimum difficulty of the network, which is only cheap
+// enough for regtest and simnet.
+type FakeBtcChain struct {
+	lock      sync.Mutex
+	netParam  *chaincfg.Params
+	blocks    []*wire.MsgBlock
+	mempool   []*wire.MsgTx
+	failures  map[string][]error
+	branch    uint32
+	nextInput uint32
+	broadcast []*wire.MsgTx
+	headers   uint32
+	ibd       bool
+}
+
+func NewFakeBtcChain(netParam *chaincfg.Params) *FakeBtcChain {
+	return &FakeBtcChain{
+		netParam: netParam,
+		blocks:   []*wire.MsgBlock{netParam.GenesisBlock},
+		mempool:  make([]*wire.MsgTx, 0),
+		failures: make(map[string][]error),
+	}
+}
+
+// Fail makes the next `times` calls of method return err.
+func (chain *FakeBtcChain) Fail(method string, times int, err error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	for i := 0; i < times; i++ {
+		chain.failures[method] = append(chain.failures[method], err)
+	}
+}
+
+func (chain *FakeBtcChain) popFailure(method string) error {
+	errs := chain.failures[method]
+	if len(errs) == 0 {
+		return nil
+	}
+	chain.failures[method] = errs[1:]
+	return errs[0]
+}
+
+func (chain *FakeBtcChain) InjectTx(tx *wire.MsgTx) chainhash.Hash {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	chain.mempool = append(chain.mempool, tx)
+	return tx.TxHash()
+}
+
+// InjectDeposit puts a deposit to the federation into the mempool. It is packed into
+// the next mined block.
+func (chain *FakeBtcChain) InjectDeposit(value int64) chainhash.Hash {
+	return chain.InjectTx(chain.NewDepositTx(value))
+}
+
+func (chain *FakeBtcChain) NewDepositTx(value int64) *wire.MsgTx {
+	redeem, _ := hex.DecodeString(observer.REDEEM_SCRIPT_HEX)
+	return chain.NewDepositTxTo(redeem, value)
+}
+
+// NewDepositTxTo builds a deposit paying value to the p2sh address of redeem.
+func (chain *FakeBtcChain) NewDepositTxTo(redeem []byte, value int64) *wire.MsgTx {
+	addr, _ := btcutil.NewAddressScriptHash(redeem, chain.netParam)
+	p2sh, _ := txscript.PayToAddrScript(addr)
+	return chain.NewDepositTxToScript(p2sh, value)
+}
+
+func (chain *FakeBtcChain) NewDepositTxToScript(pkScript []byte, value int64) *wire.MsgTx {
+	chain.lock.Lock()
+	chain.nextInput++
+	idx := chain.nextInput
+	chain.lock.Unlock()
+
+	data := make([]byte, 37)
+	data[0] = btc.OP_RETURN_SCRIPT_FLAG
+	binary.BigEndian.PutUint64(data[1:9], 2)
+	copy(data[17:], bytes.Repeat([]byte{0xab}, 20))
+	nullData, _ := txscript.NullDataScript(data)
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{0x01}, idx), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(value, pkScript))
+	tx.AddTxOut(wire.NewTxOut(0, nullData))
+	return tx
+}
+
+// NewWithdrawalTx builds a tx spending output 0 of deposit, which is not signed.
+func (chain *FakeBtcChain) NewWithdrawalTx(deposit chainhash.Hash) *wire.MsgTx {
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&deposit, 0), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(5000, []byte{txscript.OP_TRUE}))
+	return tx
+}
+
+// Mine appends n blocks to the tip, the first one takes every tx in the mempool.
+func (chain *FakeBtcChain) Mine(n int) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	for i := 0; i < n; i++ {
+		chain.mineBlock()
+	}
+}
+
+// Reorg drops the top `depth` blocks and mines n new ones on the remaining chain. Txs in the
+// dropped blocks are discarded.
+func (chain *FakeBtcChain) Reorg(depth, n int) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	chain.blocks = chain.blocks[:len(chain.blocks)-depth]
+	chain.branch++
+	for i := 0; i < n; i++ {
+		chain.mineBlock()
+	}
+}
+
+func (chain *FakeBtcChain) mineBlock() {
+	height := uint32(len(chain.blocks))
+	prev := chain.blocks[height-1]
+
+	coinbase := wire.NewMsgTx(wire.TxVersion)
+	sig := make([]byte, 8)
+	binary.LittleEndian.PutUint32(sig, height)
+	binary.LittleEndian.PutUint32(sig[4:], chain.branch)
+	coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), sig, nil))
+	coinbase.AddTxOut(wire.NewTxOut(50*btcutil.SatoshiPerBitcoin, []byte{txscript.OP_TRUE}))
+
+	block := &wire.MsgBlock{
+		Header: wire.BlockHeader{
+			Version:   1,
+			PrevBlock: prev.BlockHash(),
+			Timestamp: prev.Header.Timestamp.Add(10 * time.Minute),
+			Bits:      chain.netParam.PowLimitBits,
+		},
+		Transactions: append([]*wire.MsgTx{coinbase}, chain.mempool...),
+	}
+	chain.mempool = make([]*wire.MsgTx, 0)
+
+	txns := make([]*btcutil.Tx, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		txns[i] = btcutil.NewTx(tx)
+	}
+	store := blockchain.BuildMerkleTreeStore(txns, false)
+	block.Header.MerkleRoot = *store[len(store)-1]
+
+	for !chain.meetsTarget(&block.Header) {
+		block.Header.Nonce++
+	}
+
+	chain.blocks = append(chain.blocks, block)
+}
+
+// MineInvalid appends a block whose header doesn't satisfy proof of work.
+func (chain *FakeBtcChain) MineInvalid() {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	chain.mineBlock()
+	block := chain.blocks[len(chain.blocks)-1]
+	for chain.meetsTarget(&block.Header) {
+		block.Header.Nonce++
+	}
+}
+
+// meetsTarget reports whether header has enough proof of work for the network.
+func (chain *FakeBtcChain) meetsTarget(header *wire.BlockHeader) bool {
+	hash := header.BlockHash()
+	return blockchain.HashToBig(&hash).Cmp(blockchain.CompactToBig(header.Bits)) <= 0
+}
+
+func (chain *FakeBtcChain) Height() uint32 {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	return uint32(len(chain.blocks) - 1)
+}
+
+// SetSyncing makes the node report it's in initial block download or has more headers than
+// blocks. SetSyncing(0, false) brings it back to synced.
+func (chain *FakeBtcChain) SetSyncing(headers uint32, ibd bool) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	chain.headers = headers
+	chain.ibd = ibd
+}
+
+func (chain *FakeBtcChain) GetChainInfo() (*observer.ChainInfo, error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	if err := chain.popFailure("GetChainInfo"); err != nil {
+		return nil, err
+	}
+	blocks := uint32(len(chain.blocks) - 1)
+	headers := blocks
+	if chain.headers > headers {
+		headers = chain.headers
+	}
+	return &observer.ChainInfo{
+		Blocks:               blocks,
+		Headers:              headers,
+		BestBlockHash:        chain.blocks[blocks].BlockHash().String(),
+		InitialBlockDownload: chain.ibd,
+	}, nil
+}
+
+func (chain *FakeBtcChain) Broadcasted() []*wire.MsgTx {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	return append([]*wire.MsgTx{}, chain.broadcast...)
+}
+
+func (chain *FakeBtcChain) GetCurrentHeightAndHash() (uint32, string, error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	if err := chain.popFailure("GetCurrentHeightAndHash"); err != nil {
+		return 0, "", err
+	}
+	tip := chain.blocks[len(chain.blocks)-1]
+	return uint32(len(chain.blocks) - 1), tip.BlockHash().String(), nil
+}
+
+func (chain *FakeBtcChain) GetBlockHash(height uint32) (string, error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	if err := chain.popFailure("GetBlockHash"); err != nil {
+		return "", err
+	}
+	if int(height) >= len(chain.blocks) {
+		return "", fmt.Errorf("response shows failure: Block height out of range")
+	}
+	return chain.blocks[height].BlockHash().String(), nil
+}
+
+func (chain *FakeBtcChain) GetBlockByHeight(height uint32) (*wire.MsgBlock, string, error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	if err := chain.popFailure("GetBlockByHeight"); err != nil {
+		return nil, "", err
+	}
+	if int(height) >= len(chain.blocks) {
+		return nil, "", fmt.Errorf("response shows failure: Block height out of range")
+	}
+	block := chain.blocks[height]
+	return block, block.BlockHash().String(), nil
+}
+
+func (chain *FakeBtcChain) GetBlocksByHeightRange(start, end uint32) ([]*wire.MsgBlock, []string, error) {
+	blocks := make([]*wire.MsgBlock, 0)
+	hashes := make([]string, 0)
+	for h := start; h <= end; h++ {
+		block, hash, err := chain.GetBlockByHeight(h)
+		if err != nil {
+			return blocks, hashes, err
+		}
+		blocks = append(blocks, block)
+		hashes = append(hashes, hash)
+	}
+	return blocks, hashes, nil
+}
+
+func (chain *FakeBtcChain) GetBlockHeaders(start, end uint32) ([]*wire.BlockHeader, error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	if err := chain.popFailure("GetBlockHeaders"); err != nil {
+		return nil, err
+	}
+	if int(end) >= len(chain.blocks) {
+		return nil, fmt.Errorf("response for height %d shows failure: Block height out of range", end)
+	}
+	headers := make([]*wire.BlockHeader, 0)
+	for h := start; h <= end; h++ {
+		header := chain.blocks[h].Header
+		headers = append(headers, &header)
+	}
+	return headers, nil
+}
+
+func (chain *FakeBtcChain) GetTxsInBlockByHeight(height uint32) ([]*wire.MsgTx, string, error) {
+	block, hash, err := chain.GetBlockByHeight(height)
+	if err != nil {
+		return nil, "", err
+	}
+	return block.Transactions, hash, nil
+}
+
+func (chain *FakeBtcChain) GetProof(txids []string) (string, error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	if err := chain.popFailure("GetProof"); err != nil {
+		return "", err
+	}
+	if len(txids) == 0 {
+		return "", fmt.Errorf("response shows failure: no txid")
+	}
+	block, _ := chain.findTx(txids[0])
+	if block == nil {
+		return "", fmt.Errorf("response shows failure: Transaction not yet in block")
+	}
+
+	hashes := make([]chainhash.Hash, 0, len(txids))
+	for _, id := range txids {
+		h, err := chainhash.NewHashFromStr(id)
+		if err != nil {
+			return "", err
+		}
+		hashes = append(hashes, *h)
+	}
+	proof, err := observer.BuildMerkleProof(block, hashes)
+	if err != nil {
+		return "", fmt.Errorf("response shows failure: %v", err)
+	}
+	return hex.EncodeToString(proof), nil
+}
+
+func (chain *FakeBtcChain) BroadcastTx(tx string) (string, error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	if err := chain.popFailure("BroadcastTx"); err != nil {
+		return "", err
+	}
+	txb, err := hex.DecodeString(tx)
+	if err != nil {
+		return "", fmt.Errorf("[BroadcastTx] response shows failure: %v", err)
+	}
+	mtx := wire.NewMsgTx(wire.TxVersion)
+	if err = mtx.BtcDecode(bytes.NewBuffer(txb), wire.ProtocolVersion, wire.LatestEncoding); err != nil {
+		return "", fmt.Errorf("[BroadcastTx] response shows failure: %v", err)
+	}
+	chain.mempool = append(chain.mempool, mtx)
+	chain.broadcast = append(chain.broadcast, mtx)
+	return mtx.TxHash().String(), nil
+}
+
+func (chain *FakeBtcChain) GetRawMempool() ([]string, error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	if err := chain.popFailure("GetRawMempool"); err != nil {
+		return nil, err
+	}
+	txids := make([]string, 0)
+	for _, mtx := range chain.mempool {
+		txids = append(txids, mtx.TxHash().String())
+	}
+	return txids, nil
+}
+
+func (chain *FakeBtcChain) GetRawTransaction(txid string) (*wire.MsgTx, error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	if err := chain.popFailure("GetRawTransaction"); err != nil {
+		return nil, err
+	}
+	for _, mtx := range chain.mempool {
+		if mtx.TxHash().String() == txid {
+			return mtx, nil
+		}
+	}
+	if _, tx := chain.findTx(txid); tx != nil {
+		return tx, nil
+	}
+	return nil, observer.TxNotFoundErr{Err: fmt.Errorf("tx %s not found: No such mempool or blockchain transaction", txid)}
+}
+
+func (chain *FakeBtcChain) GetTxConfirmations(txid string) (uint32, error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	if err := chain.popFailure("GetTxConfirmations"); err != nil {
+		return 0, err
+	}
+	for h := len(chain.blocks) - 1; h >= 0; h-- {
+		for _, tx := range chain.blocks[h].Transactions {
+			if tx.TxHash().String() == txid {
+				return uint32(len(chain.blocks) - h), nil
+			}
+		}
+	}
+	for _, mtx := range chain.mempool {
+		if mtx.TxHash().String() == txid {
+			return 0, nil
+		}
+	}
+	return 0, observer.TxNotFoundErr{Err: fmt.Errorf("tx %s not found: No such mempool or blockchain transaction", txid)}
+}
+
+func (chain *FakeBtcChain) GetScriptPubKey(txid string, index uint32) (string, error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	if err := chain.popFailure("GetScriptPubKey"); err != nil {
+		return "", err
+	}
+	_, tx := chain.findTx(txid)
+	if tx == nil {
+		for _, mtx := range chain.mempool {
+			if mtx.TxHash().String() == txid {
+				tx = mtx
+			}
+		}
+	}
+	if tx == nil {
+		return "", observer.TxNotFoundErr{Err: fmt.Errorf("[GetScriptPubKey] tx %s not found: No such transaction", txid)}
+	}
+	if int(index) >= len(tx.TxOut) {
+		return "", fmt.Errorf("[GetScriptPubKey] tx %s has no output %d", txid, index)
+	}
+	return hex.EncodeToString(tx.TxOut[index].PkScript), nil
+}
+
+func (chain *FakeBtcChain) findTx(txid string) (*wire.MsgBlock, *wire.MsgTx) {
+	for _, block := range chain.blocks {
+		for _, tx := range block.Transactions {
+			if tx.TxHash().String() == txid {
+				return block, tx
+			}
+		}
+	}
+	return nil, nil
+}
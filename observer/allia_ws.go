@@ -0,0 +1,124 @@
+package observer
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/ontio/btcrelayer/log"
+	"time"
+)
+
+const (
+	WS_ACTION_SUBSCRIBE      = "subscribe"
+	WS_ACTION_BLOCK_TXHASHES = "sendblocktxhashs"
+)
+
+type wsSubscribeReq struct {
+	Action                string   `json:"Action"`
+	Version               string   `json:"Version"`
+	ContractsFilter       []string `json:"ContractsFilter"`
+	SubscribeEvent        bool     `json:"SubscribeEvent"`
+	SubscribeBlockTxHashs bool     `json:"SubscribeBlockTxHashs"`
+}
+
+type wsMessage struct {
+	Action string          `json:"Action"`
+	Desc   string          `json:"Desc"`
+	Error  int64           `json:"Error"`
+	Result json.RawMessage `json:"Result"`
+}
+
+type wsBlockTxHashes struct {
+	Height    uint32   `json:"Height"`
+	BlockHash string   `json:"BlockHash"`
+	TxHashes  []string `json:"TxHashs"`
+}
+
+func (observer *AllianceObserver) dialWs() (*websocket.Conn, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(observer.conf.AllianceWsAddress, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.WriteJSON(&wsSubscribeReq{
+		Action:                WS_ACTION_SUBSCRIBE,
+		Version:               "1.0.0",
+		SubscribeBlockTxHashs: true,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to subscribe: %v", err)
+	}
+	return conn, nil
+}
+
+// subscribe captures the blocks announced by the websocket until the connection is lost, and
+// returns the last committed height. A pushed block only wakes the observer up, its events and
+// the ones of any block missed before it are loaded from the node like polling does, so none
+// is lost whatever the order of the pushes.
+func (observer *AllianceObserver) subscribe(top uint32, collecting chan *FromAllianceItem) uint32 {
+	conn, err := observer.dialWs()
+	if err != nil {
+		log.Errorf("[AllianceObserver] failed to connect to %s: %v", observer.conf.AllianceWsAddress, err)
+		return top
+	}
+	defer conn.Close()
+	log.Infof("[AllianceObserver] subscribed to %s", observer.conf.AllianceWsAddress)
+
+	newTop, err := observer.allia.GetCurrentBlockHeight()
+	if err != nil {
+		log.Errorf("[AllianceObserver] failed to get current height: %v", err)
+		return top
+	}
+	if top, err = observer.fill(top, newTop, collecting); err != nil {
+		log.Errorf("[AllianceObserver] failed to catch up to height %d: %v", newTop, err)
+		return top
+	}
+
+	// alliance blocks come every few seconds, a silent connection is taken as lost
+	timeout := time.Duration(observer.conf.AlliaObLoopWaitTime) * time.Second * 20
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		msg := &wsMessage{}
+		if err := conn.ReadJSON(msg); err != nil {
+			log.Errorf("[AllianceObserver] failed to read from websocket: %v", err)
+			return top
+		}
+		if msg.Error != 0 {
+			log.Errorf("[AllianceObserver] websocket returns error %d on %s: %s", msg.Error, msg.Action, msg.Desc)
+			continue
+		}
+		if msg.Action != WS_ACTION_BLOCK_TXHASHES {
+			continue
+		}
+		block := &wsBlockTxHashes{}
+		if err := json.Unmarshal(msg.Result, block); err != nil {
+			log.Errorf("[AllianceObserver] failed to decode pushed block: %v", err)
+			return top
+		}
+		if block.Height <= top {
+			continue
+		}
+		if top, err = observer.fill(top, block.Height, collecting); err != nil {
+			log.Errorf("[AllianceObserver] failed to capture blocks up to pushed height %d: %v", block.Height, err)
+			return top
+		}
+	}
+}
+
+// fill polls the blocks (top, to] and returns the last committed height.
+func (observer *AllianceObserver) fill(top, to uint32, collecting chan *FromAllianceItem) (uint32, error) {
+	for top < to {
+		items, err := observer.searchEventsInBlock(top + 1)
+		if err != nil {
+			return top, err
+		}
+		if err = observer.commitBlock(top+1, items, collecting); err != nil {
+			return top, err
+		}
+		top++
+	}
+	return top, nil
+}
@@ -0,0 +1,45 @@
+package observer
+
+import (
+	"fmt"
+	sdk "github.com/ontio/multi-chain-go-sdk"
+	sdkcom "github.com/ontio/multi-chain-go-sdk/common"
+	"github.com/ontio/multi-chain/common"
+	"github.com/ontio/multi-chain/native/service/utils"
+)
+
+// BTC_TX_PREFIX is the storage prefix under which the btc handler of the cross chain manager
+// marks the imported btc txs.
+const BTC_TX_PREFIX = "btctx"
+
+type AllianceClient interface {
+	GetCurrentBlockHeight() (uint32, error)
+	GetSmartContractEventByBlock(height uint32) ([]*sdkcom.SmartContactEvent, error)
+	GetSmartContractEvent(txHash string) (*sdkcom.SmartContactEvent, error)
+	GetStorage(contractAddress string, key []byte) ([]byte, error)
+	ImportOuterTransfer(sourceChainId uint64, txid []byte, tx []byte, height uint32, proof []byte, relayer []byte,
+		signer *sdk.Account) (common.Uint256, error)
+}
+
+type allianceSdkClient struct {
+	*sdk.MultiChainSdk
+}
+
+func NewAllianceClient(allia *sdk.MultiChainSdk) AllianceClient {
+	return &allianceSdkClient{allia}
+}
+
+func (cli *allianceSdkClient) ImportOuterTransfer(sourceChainId uint64, txid []byte, tx []byte, height uint32, proof []byte,
+	relayer []byte, signer *sdk.Account) (common.Uint256, error) {
+	return cli.Native.Ccm.ImportOuterTransfer(sourceChainId, txid, tx, height, proof, relayer, signer)
+}
+
+// CheckIfImported tells if the btc tx with txid is already imported to the alliance.
+func CheckIfImported(allia AllianceClient, txid []byte) (bool, error) {
+	val, err := allia.GetStorage(utils.CrossChainManagerContractAddress.ToHexString(),
+		append([]byte(BTC_TX_PREFIX), txid...))
+	if err != nil {
+		return false, fmt.Errorf("failed to get storage: %v", err)
+	}
+	return len(val) > 0, nil
+}
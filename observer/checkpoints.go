@@ -2,6 +2,7 @@ package observer
 
 type Checkpoint struct {
 	Height uint32
+	Hash   string // btc only, if empty the header chain is anchored at the latest btcd checkpoint below
 }
 
 var btcCheckPoints map[string]*Checkpoint
@@ -14,8 +15,11 @@ func init() {
 	btcCheckPoints["regtest"] = &Checkpoint{
 		Height: 5,
 	}
+	btcCheckPoints["simnet"] = &Checkpoint{
+		Height: 5,
+	}
 	btcCheckPoints["mainnet"] = &Checkpoint{
-		Height: 602805, // need to set
+		Height: 602805,
 	}
 	btcCheckPoints["testnet3"] = &Checkpoint{
 		Height: 1607304,
@@ -0,0 +1,68 @@
+package observer
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	BACKEND_BITCOIND = "bitcoind"
+	BACKEND_ESPLORA  = "esplora"
+)
+
+type BtcClient interface {
+	GetCurrentHeightAndHash() (uint32, string, error)
+	GetChainInfo() (*ChainInfo, error)
+	GetBlockHash(height uint32) (string, error)
+	GetBlockByHeight(height uint32) (*wire.MsgBlock, string, error)
+	GetBlocksByHeightRange(start, end uint32) ([]*wire.MsgBlock, []string, error)
+	GetBlockHeaders(start, end uint32) ([]*wire.BlockHeader, error)
+	GetTxsInBlockByHeight(height uint32) ([]*wire.MsgTx, string, error)
+	GetProof(txids []string) (string, error)
+	BroadcastTx(tx string) (string, error)
+	GetRawMempool() ([]string, error)
+	GetRawTransaction(txid string) (*wire.MsgTx, error)
+	GetTxConfirmations(txid string) (uint32, error)
+	GetScriptPubKey(txid string, index uint32) (string, error)
+}
+
+func NewBtcClient(conf *BtcObConfig) (BtcClient, error) {
+	if conf.BtcQuorum > 1 && (len(conf.BtcEndpoints) == 0 || conf.BtcBackend == BACKEND_ESPLORA) {
+		return nil, fmt.Errorf("btc_quorum %d needs btc_endpoints of the bitcoind backend", conf.BtcQuorum)
+	}
+	switch conf.BtcBackend {
+	case "", BACKEND_BITCOIND:
+		if len(conf.BtcEndpoints) == 0 {
+			return NewRestCli(conf.BtcJsonRpcAddress, conf.User, conf.Pwd), nil
+		}
+		return newMultiRestCli(conf)
+	case BACKEND_ESPLORA:
+		return NewEsploraCli(conf.EsploraAddress), nil
+	default:
+		return nil, fmt.Errorf("unknown btc backend %s", conf.BtcBackend)
+	}
+}
+
+// newMultiRestCli puts btc_json_rpc_address, if set, in front of btc_endpoints. Endpoints
+// without credentials use user and pwd.
+func newMultiRestCli(conf *BtcObConfig) (BtcClient, error) {
+	endpoints := conf.BtcEndpoints
+	if conf.BtcJsonRpcAddress != "" {
+		endpoints = append([]*BtcEndpoint{{Address: conf.BtcJsonRpcAddress}}, endpoints...)
+	}
+	names := make([]string, 0, len(endpoints))
+	clis := make([]BtcClient, 0, len(endpoints))
+	for _, ep := range endpoints {
+		user, pwd := ep.User, ep.Pwd
+		if user == "" {
+			user, pwd = conf.User, conf.Pwd
+		}
+		names = append(names, ep.Address)
+		clis = append(clis, NewRestCli(ep.Address, user, pwd))
+	}
+	cli, err := NewMultiCli(names, clis, conf.BtcQuorum)
+	if err != nil {
+		return nil, err
+	}
+	return cli, nil
+}
@@ -0,0 +1,351 @@
+package observer
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EsploraCli reads bitcoin from an Esplora HTTP indexer, e.g. https://blockstream.info/testnet/api
+type EsploraCli struct {
+	Addr string
+	Cli  *http.Client
+}
+
+func NewEsploraCli(addr string) *EsploraCli {
+	return &EsploraCli{
+		Addr: strings.TrimRight(addr, "/"),
+		Cli: &http.Client{
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost:   5,
+				IdleConnTimeout:       time.Second * 300,
+				ResponseHeaderTimeout: time.Second * 300,
+			},
+			Timeout: time.Second * 300,
+		},
+	}
+}
+
+type esploraStatusErr struct {
+	code int
+	body string
+}
+
+func (err esploraStatusErr) Error() string {
+	return fmt.Sprintf("status %d: %s", err.code, err.body)
+}
+
+func (cli *EsploraCli) do(method, path string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, cli.Addr+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to new request: %v", err)
+	}
+	resp, err := cli.Cli.Do(req)
+	if err != nil {
+		return nil, NetErr{fmt.Errorf("failed to %s %s: %v", method, path, err)}
+	}
+	defer resp.Body.Close()
+	rb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response body error:%s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, esploraStatusErr{resp.StatusCode, strings.TrimSpace(string(rb))}
+	}
+	return rb, nil
+}
+
+func (cli *EsploraCli) get(path string) ([]byte, error) {
+	return cli.do(http.MethodGet, path, nil)
+}
+
+func (cli *EsploraCli) GetCurrentHeightAndHash() (uint32, string, error) {
+	hb, err := cli.get("/blocks/tip/height")
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to get tip height: %v", err)
+	}
+	height, err := strconv.ParseUint(strings.TrimSpace(string(hb)), 10, 32)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to parse tip height: %v", err)
+	}
+	hash, err := cli.GetBlockHash(uint32(height))
+	if err != nil {
+		return 0, "", err
+	}
+	return uint32(height), hash, nil
+}
+
+// GetChainInfo takes the tip as both blocks and headers, since esplora only serves what its
+// node has fully indexed.
+func (cli *EsploraCli) GetChainInfo() (*ChainInfo, error) {
+	height, hash, err := cli.GetCurrentHeightAndHash()
+	if err != nil {
+		return nil, err
+	}
+	return &ChainInfo{
+		Blocks:        height,
+		Headers:       height,
+		BestBlockHash: hash,
+	}, nil
+}
+
+func (cli *EsploraCli) GetBlockHash(height uint32) (string, error) {
+	hash, err := cli.get(fmt.Sprintf("/block-height/%d", height))
+	if err != nil {
+		return "", fmt.Errorf("failed to get hash at height %d: %v", height, err)
+	}
+	return strings.TrimSpace(string(hash)), nil
+}
+
+func (cli *EsploraCli) GetBlock(hash string) (*wire.MsgBlock, error) {
+	raw, err := cli.get(fmt.Sprintf("/block/%s/raw", hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get raw block %s: %v", hash, err)
+	}
+	block := &wire.MsgBlock{}
+	err = block.BtcDecode(bytes.NewBuffer(raw), wire.ProtocolVersion, wire.LatestEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode block %s: %v", hash, err)
+	}
+	return block, nil
+}
+
+func (cli *EsploraCli) GetBlockByHeight(height uint32) (*wire.MsgBlock, string, error) {
+	hash, err := cli.GetBlockHash(height)
+	if err != nil {
+		return nil, "", err
+	}
+	block, err := cli.GetBlock(hash)
+	if err != nil {
+		return nil, "", err
+	}
+	return block, hash, nil
+}
+
+func (cli *EsploraCli) GetBlocksByHeightRange(start, end uint32) ([]*wire.MsgBlock, []string, error) {
+	blocks := make([]*wire.MsgBlock, 0)
+	hashes := make([]string, 0)
+	for h := start; h <= end; h++ {
+		block, hash, err := cli.GetBlockByHeight(h)
+		if err != nil {
+			return blocks, hashes, err
+		}
+		blocks = append(blocks, block)
+		hashes = append(hashes, hash)
+	}
+	return blocks, hashes, nil
+}
+
+// esploraBlock is a block summary from /blocks/:start_height.
+type esploraBlock struct {
+	Id                string `json:"id"`
+	Height            uint32 `json:"height"`
+	Version           int32  `json:"version"`
+	Timestamp         int64  `json:"timestamp"`
+	Bits              uint32 `json:"bits"`
+	Nonce             uint32 `json:"nonce"`
+	MerkleRoot        string `json:"merkle_root"`
+	PreviousBlockHash string `json:"previousblockhash"`
+}
+
+func (b *esploraBlock) header() (*wire.BlockHeader, error) {
+	header := &wire.BlockHeader{
+		Version:   b.Version,
+		Timestamp: time.Unix(b.Timestamp, 0),
+		Bits:      b.Bits,
+		Nonce:     b.Nonce,
+	}
+	merkle, err := chainhash.NewHashFromStr(b.MerkleRoot)
+	if err != nil {
+		return nil, fmt.Errorf("wrong merkle root: %v", err)
+	}
+	header.MerkleRoot = *merkle
+	// the genesis block has no previous block
+	if b.PreviousBlockHash != "" {
+		prev, err := chainhash.NewHashFromStr(b.PreviousBlockHash)
+		if err != nil {
+			return nil, fmt.Errorf("wrong previous block hash: %v", err)
+		}
+		header.PrevBlock = *prev
+	}
+	if hash := header.BlockHash().String(); hash != b.Id {
+		return nil, fmt.Errorf("header hashes to %s, not %s", hash, b.Id)
+	}
+	return header, nil
+}
+
+// GetBlockHeaders pages through /blocks/:start_height from end down to start. Each page holds
+// the summaries of up to 10 blocks below and at the height asked.
+func (cli *EsploraCli) GetBlockHeaders(start, end uint32) ([]*wire.BlockHeader, error) {
+	if end < start {
+		return []*wire.BlockHeader{}, nil
+	}
+	headers := make([]*wire.BlockHeader, end-start+1)
+	top := int64(end)
+	for top >= int64(start) {
+		rb, err := cli.get(fmt.Sprintf("/blocks/%d", top))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get blocks below %d: %v", top, err)
+		}
+		blocks := make([]*esploraBlock, 0)
+		if err = json.Unmarshal(rb, &blocks); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal blocks below %d: %v", top, err)
+		}
+		if len(blocks) == 0 {
+			return nil, fmt.Errorf("no blocks below %d", top)
+		}
+		for _, b := range blocks {
+			if int64(b.Height) > top {
+				return nil, fmt.Errorf("block %s at height %d is above %d", b.Id, b.Height, top)
+			}
+			if b.Height < start {
+				break
+			}
+			header, err := b.header()
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode header %s: %v", b.Id, err)
+			}
+			headers[b.Height-start] = header
+		}
+		top = int64(blocks[len(blocks)-1].Height) - 1
+	}
+	for i, header := range headers {
+		if header == nil {
+			return nil, fmt.Errorf("no header at height %d", start+uint32(i))
+		}
+	}
+	return headers, nil
+}
+
+func (cli *EsploraCli) GetTxsInBlockByHeight(height uint32) ([]*wire.MsgTx, string, error) {
+	block, hash, err := cli.GetBlockByHeight(height)
+	if err != nil {
+		return nil, "", err
+	}
+	return block.Transactions, hash, nil
+}
+
+func (cli *EsploraCli) GetProof(txids []string) (string, error) {
+	if len(txids) != 1 {
+		return "", fmt.Errorf("esplora only proves one tx at a time, not %d", len(txids))
+	}
+	proof, err := cli.get(fmt.Sprintf("/tx/%s/merkleblock-proof", txids[0]))
+	if err != nil {
+		return "", fmt.Errorf("failed to get proof: %v", err)
+	}
+	return strings.TrimSpace(string(proof)), nil
+}
+
+func (cli *EsploraCli) BroadcastTx(tx string) (string, error) {
+	txid, err := cli.do(http.MethodPost, "/tx", []byte(tx))
+	if err != nil {
+		if serr, ok := err.(esploraStatusErr); ok {
+			if strings.Contains(serr.body, fmt.Sprintf(`"code":%d`, btcjson.ErrRPCTxError)) ||
+				strings.Contains(serr.body, fmt.Sprintf(`"code":%d`, btcjson.ErrRPCTxRejected)) {
+				return "", NeedToRetryErr{
+					Err: fmt.Errorf("[BroadcastTx] response shows failure and retry: %v", serr),
+				}
+			}
+			if strings.Contains(serr.body, fmt.Sprintf(`"code":%d`, btcjson.ErrRPCTxAlreadyInChain)) {
+				return "", TxInChainErr{
+					Err: fmt.Errorf("[BroadcastTx] response shows failure: %v", serr),
+				}
+			}
+			return "", fmt.Errorf("[BroadcastTx] response shows failure: %v", serr)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(txid)), nil
+}
+
+func (cli *EsploraCli) GetRawMempool() ([]string, error) {
+	rb, err := cli.get("/mempool/txids")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mempool: %v", err)
+	}
+	txids := make([]string, 0)
+	if err = json.Unmarshal(rb, &txids); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal mempool: %v", err)
+	}
+	return txids, nil
+}
+
+func (cli *EsploraCli) GetRawTransaction(txid string) (*wire.MsgTx, error) {
+	raw, err := cli.get(fmt.Sprintf("/tx/%s/raw", txid))
+	if err != nil {
+		if _, ok := err.(NetErr); ok {
+			return nil, err
+		}
+		if se, ok := err.(esploraStatusErr); ok && se.code == http.StatusNotFound {
+			return nil, TxNotFoundErr{fmt.Errorf("tx %s not found: %v", txid, err)}
+		}
+		return nil, fmt.Errorf("failed to get raw tx %s: %v", txid, err)
+	}
+	mtx := wire.NewMsgTx(wire.TxVersion)
+	if err = mtx.BtcDecode(bytes.NewBuffer(raw), wire.ProtocolVersion, wire.LatestEncoding); err != nil {
+		return nil, fmt.Errorf("failed to decode tx %s: %v", txid, err)
+	}
+	return mtx, nil
+}
+
+func (cli *EsploraCli) GetTxConfirmations(txid string) (uint32, error) {
+	rb, err := cli.get(fmt.Sprintf("/tx/%s/status", txid))
+	if err != nil {
+		if serr, ok := err.(esploraStatusErr); ok && serr.code == http.StatusNotFound {
+			return 0, TxNotFoundErr{fmt.Errorf("tx %s not found: %v", txid, err)}
+		}
+		return 0, fmt.Errorf("failed to get status of tx %s: %v", txid, err)
+	}
+	status := struct {
+		Confirmed   bool   `json:"confirmed"`
+		BlockHeight uint32 `json:"block_height"`
+	}{}
+	if err = json.Unmarshal(rb, &status); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal status of tx %s: %v", txid, err)
+	}
+	if !status.Confirmed {
+		return 0, nil
+	}
+	height, _, err := cli.GetCurrentHeightAndHash()
+	if err != nil {
+		return 0, err
+	}
+	return height - status.BlockHeight + 1, nil
+}
+
+func (cli *EsploraCli) GetScriptPubKey(txid string, index uint32) (string, error) {
+	rb, err := cli.get(fmt.Sprintf("/tx/%s", txid))
+	if err != nil {
+		if _, ok := err.(NetErr); ok {
+			return "", NetErr{fmt.Errorf("[GetScriptPubKey] failed to get tx: %v", err)}
+		}
+		if se, ok := err.(esploraStatusErr); ok && se.code == http.StatusNotFound {
+			return "", TxNotFoundErr{fmt.Errorf("[GetScriptPubKey] tx %s not found: %v", txid, err)}
+		}
+		return "", fmt.Errorf("[GetScriptPubKey] failed to get tx: %v", err)
+	}
+	tx := struct {
+		Vout []struct {
+			ScriptPubKey string `json:"scriptpubkey"`
+		} `json:"vout"`
+	}{}
+	if err = json.Unmarshal(rb, &tx); err != nil {
+		return "", fmt.Errorf("[GetScriptPubKey] failed to unmarshal tx: %v", err)
+	}
+	if int(index) >= len(tx.Vout) {
+		return "", fmt.Errorf("[GetScriptPubKey] tx %s has no output %d", txid, index)
+	}
+	if _, err = hex.DecodeString(tx.Vout[index].ScriptPubKey); err != nil {
+		return "", fmt.Errorf("[GetScriptPubKey] wrong scriptpubkey: %v", err)
+	}
+	return tx.Vout[index].ScriptPubKey, nil
+}
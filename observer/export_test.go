@@ -0,0 +1,89 @@
+package observer
+
+import (
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ontio/btcrelayer/db"
+)
+
+// The tests driving the observers against the fakes in internal/testutil live in observer_test,
+// since the fakes import this package. These expose the internals they check.
+
+var (
+	NewFederation       = newFederation
+	CheckIfCrossChainTx = checkIfCrossChainTx
+	FederationPkScripts = federationPkScripts
+)
+
+const (
+	DefaultPendingExpiry = defaultPendingExpiry
+	MaxTxNotFoundTries   = maxTxNotFoundTries
+)
+
+type (
+	WsSubscribeReq  = wsSubscribeReq
+	WsMessage       = wsMessage
+	WsBlockTxHashes = wsBlockTxHashes
+)
+
+func (observer *BtcObserver) Conf() *BtcObConfig {
+	return observer.conf
+}
+
+func (observer *BtcObserver) RetryDB() *db.RetryDB {
+	return observer.retryDB
+}
+
+func (observer *BtcObserver) Header(height uint32) *wire.BlockHeader {
+	return observer.headers.get(height)
+}
+
+// SetCli replaces the client and the fetcher using it.
+func (observer *BtcObserver) SetCli(cli BtcClient, workers int, batch uint32) {
+	observer.cli = cli
+	observer.fetcher = newBlockFetcher(cli, workers, batch)
+}
+
+func (observer *BtcObserver) SetZmq(zmq *ZmqSubscriber) {
+	observer.zmq = zmq
+}
+
+func (observer *MempoolObserver) Poll() error {
+	return observer.poll()
+}
+
+func (observer *MempoolObserver) Prune() {
+	observer.prune()
+}
+
+func (observer *AllianceObserver) RetryDB() *db.RetryDB {
+	return observer.retryDB
+}
+
+func (observer *AllianceObserver) Validator() *WithdrawalValidator {
+	return observer.validator
+}
+
+func (observer *AllianceObserver) SearchEventsInBlock(height uint32) ([]*FromAllianceItem, error) {
+	return observer.searchEventsInBlock(height)
+}
+
+func (v *WithdrawalValidator) PkScripts(i int) [][]byte {
+	return v.fed.scripts[i].pkScripts
+}
+
+// Names returns the endpoints in the order they're tried.
+func (m *MultiCli) Names() []string {
+	names := make([]string, 0)
+	for _, e := range m.order() {
+		names = append(names, e.name)
+	}
+	return names
+}
+
+func (m *MultiCli) Failures() []int {
+	failures := make([]int, 0)
+	for _, e := range m.endpoints {
+		failures = append(failures, e.failures)
+	}
+	return failures
+}
@@ -0,0 +1,142 @@
+package observer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+)
+
+// FederationScript is a redeem script of the federation. It is watched from ActivationHeight
+// until RetireHeight(excluded), and RetireHeight 0 means it never retires. Let the old script
+// retire some blocks after the new one activates to watch both during a handover.
+type FederationScript struct {
+	RedeemScript     string `json:"redeem_script"`
+	ActivationHeight uint32 `json:"activation_height"`
+	RetireHeight     uint32 `json:"retire_height"`
+}
+
+type federationScript struct {
+	redeem     []byte
+	pkScripts  [][]byte
+	activation uint32
+	retire     uint32
+}
+
+func (fs *federationScript) isActive(height uint32) bool {
+	return height >= fs.activation && (fs.retire == 0 || height < fs.retire)
+}
+
+func (fs *federationScript) owns(pkScript []byte) bool {
+	for _, s := range fs.pkScripts {
+		if bytes.Equal(s, pkScript) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWitness tells if pkScript, which should be owned by fs, is spent with a witness.
+func (fs *federationScript) isWitness(pkScript []byte) bool {
+	return !bytes.Equal(pkScript, fs.pkScripts[0])
+}
+
+type federation struct {
+	scripts []*federationScript
+}
+
+func newFederation(conf []*FederationScript, netParam *chaincfg.Params) (*federation, error) {
+	if len(conf) == 0 {
+		conf = []*FederationScript{
+			{
+				RedeemScript: REDEEM_SCRIPT_HEX,
+			},
+		}
+	}
+
+	fed := &federation{
+		scripts: make([]*federationScript, 0, len(conf)),
+	}
+	for i, c := range conf {
+		if c.RetireHeight != 0 && c.RetireHeight <= c.ActivationHeight {
+			return nil, fmt.Errorf("no%d federation script retires at %d before activation %d", i,
+				c.RetireHeight, c.ActivationHeight)
+		}
+		redeem, err := hex.DecodeString(c.RedeemScript)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode no%d federation script: %v", i, err)
+		}
+		pkScripts, err := federationPkScripts(redeem, netParam)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get pkScripts of no%d federation script: %v", i, err)
+		}
+		fed.scripts = append(fed.scripts, &federationScript{
+			redeem:     redeem,
+			pkScripts:  pkScripts,
+			activation: c.ActivationHeight,
+			retire:     c.RetireHeight,
+		})
+	}
+
+	return fed, nil
+}
+
+// federationPkScripts returns the p2sh, p2wsh and p2sh-p2wsh pkScripts locking to redeem.
+func federationPkScripts(redeem []byte, netParam *chaincfg.Params) ([][]byte, error) {
+	p2shAddr, err := btcutil.NewAddressScriptHash(redeem, netParam)
+	if err != nil {
+		return nil, err
+	}
+	p2sh, err := txscript.PayToAddrScript(p2shAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	witnessProgram := sha256.Sum256(redeem)
+	p2wshAddr, err := btcutil.NewAddressWitnessScriptHash(witnessProgram[:], netParam)
+	if err != nil {
+		return nil, err
+	}
+	p2wsh, err := txscript.PayToAddrScript(p2wshAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	nestedAddr, err := btcutil.NewAddressScriptHash(p2wsh, netParam)
+	if err != nil {
+		return nil, err
+	}
+	nested, err := txscript.PayToAddrScript(nestedAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return [][]byte{p2sh, p2wsh, nested}, nil
+}
+
+// match returns the federation script active at height that pkScript pays to.
+func (fed *federation) match(pkScript []byte, height uint32) *federationScript {
+	for _, fs := range fed.scripts {
+		if !fs.isActive(height) {
+			continue
+		}
+		if fs.owns(pkScript) {
+			return fs
+		}
+	}
+	return nil
+}
+
+// owner returns the script pkScript pays to, whether it's active or not. Outputs of retired
+// scripts can still be spent.
+func (fed *federation) owner(pkScript []byte) *federationScript {
+	for _, fs := range fed.scripts {
+		if fs.owns(pkScript) {
+			return fs
+		}
+	}
+	return nil
+}
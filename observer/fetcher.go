@@ -0,0 +1,84 @@
+package observer
+
+import (
+	"github.com/btcsuite/btcd/wire"
+)
+
+type fetchedBlocks struct {
+	start  uint32
+	blocks []*wire.MsgBlock
+	hashes []string
+	err    error
+}
+
+type blockFetcher struct {
+	cli     BtcClient
+	workers int
+	batch   uint32
+}
+
+func newBlockFetcher(cli BtcClient, workers int, batch uint32) *blockFetcher {
+	if workers <= 0 {
+		workers = DefaultFetchWorkers
+	}
+	if batch == 0 {
+		batch = DefaultBatchSize
+	}
+	return &blockFetcher{
+		cli:     cli,
+		workers: workers,
+		batch:   batch,
+	}
+}
+
+// fetch prefetches the blocks in (from, to] by batches, with at most `workers` batches in
+// flight, and hands them out in height order. A batch that failed carries the blocks before
+// the failed one and the error. Closing quit stops the workers.
+func (f *blockFetcher) fetch(from, to uint32, quit <-chan struct{}) <-chan *fetchedBlocks {
+	out := make(chan *fetchedBlocks)
+	slots := make(chan chan *fetchedBlocks, f.workers)
+
+	go func() {
+		defer close(slots)
+		for start := from + 1; start <= to && start > from; start += f.batch {
+			end := start + f.batch - 1
+			if end > to || end < start {
+				end = to
+			}
+			slot := make(chan *fetchedBlocks, 1)
+			select {
+			case slots <- slot:
+			case <-quit:
+				return
+			}
+			go func(start, end uint32) {
+				blocks, hashes, err := f.cli.GetBlocksByHeightRange(start, end)
+				slot <- &fetchedBlocks{
+					start:  start,
+					blocks: blocks,
+					hashes: hashes,
+					err:    err,
+				}
+			}(start, end)
+		}
+	}()
+
+	go func() {
+		defer close(out)
+		for slot := range slots {
+			var res *fetchedBlocks
+			select {
+			case res = <-slot:
+			case <-quit:
+				return
+			}
+			select {
+			case out <- res:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,302 @@
+package observer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ontio/btcrelayer/db"
+	"github.com/ontio/btcrelayer/log"
+	"math/big"
+	"time"
+)
+
+// headerChain is the local copy of the btc header chain, starting from the first block of the
+// retarget period its anchor is in. The anchor is the checkpoint if its hash is known, or else
+// the latest checkpoint of btcd below it. Every block is checked against the chain before it's
+// scanned, so a misbehaving node can't make us relay from blocks that are not on a valid chain.
+type headerChain struct {
+	netParam          *chaincfg.Params
+	retryDB           *db.RetryDB
+	checkpoint        *Checkpoint
+	anchor            *Checkpoint
+	blocksPerRetarget uint32
+	minTimespan       int64
+	maxTimespan       int64
+}
+
+// headersPerFetch limits the headers asked from the node at once when backfilling.
+const headersPerFetch = 2000
+
+func newHeaderChain(netParam *chaincfg.Params, rdb *db.RetryDB) (*headerChain, error) {
+	targetTimespan := int64(netParam.TargetTimespan / time.Second)
+	checkpoint, ok := btcCheckPoints[netParam.Name]
+	if !ok {
+		return nil, fmt.Errorf("no checkpoint for btc net %s", netParam.Name)
+	}
+	anchor := checkpoint
+	if checkpoint.Hash == "" {
+		for i := len(netParam.Checkpoints) - 1; i >= 0; i-- {
+			if cp := netParam.Checkpoints[i]; uint32(cp.Height) <= checkpoint.Height {
+				anchor = &Checkpoint{Height: uint32(cp.Height), Hash: cp.Hash.String()}
+				break
+			}
+		}
+	}
+	return &headerChain{
+		netParam:          netParam,
+		retryDB:           rdb,
+		checkpoint:        checkpoint,
+		anchor:            anchor,
+		blocksPerRetarget: uint32(netParam.TargetTimespan / netParam.TargetTimePerBlock),
+		minTimespan:       targetTimespan / netParam.RetargetAdjustmentFactor,
+		maxTimespan:       targetTimespan * netParam.RetargetAdjustmentFactor,
+	}, nil
+}
+
+// bootstrap makes sure the local chain has every header up to height, which is the last one
+// scanned. The headers from the start of the anchor's retarget period up to the anchor are
+// fetched first, then the ones after are validated against them and appended. It does nothing
+// once they're stored.
+func (hc *headerChain) bootstrap(cli BtcClient, height uint32) error {
+	if hc.get(height) != nil {
+		return nil
+	}
+	if hc.get(hc.anchor.Height) == nil {
+		if err := hc.fetchAnchor(cli, height); err != nil {
+			return err
+		}
+		if hc.get(height) != nil {
+			return nil
+		}
+	}
+	if height < hc.anchor.Height {
+		return fmt.Errorf("no header at height %d below checkpoint %d in local chain", height, hc.anchor.Height)
+	}
+
+	// headers are stored without gaps from the anchor, so search for the last one
+	low, high := hc.anchor.Height, height
+	for high-low > 1 {
+		mid := low + (high-low)/2
+		if hc.get(mid) != nil {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+	for start := low + 1; start <= height; start += headersPerFetch {
+		end := start + headersPerFetch - 1
+		if end > height {
+			end = height
+		}
+		if err := hc.backfill(cli, start, end); err != nil {
+			return err
+		}
+	}
+	log.Infof("[headerChain] backfilled headers from %d to %d", low+1, height)
+	return nil
+}
+
+// fetchAnchor stores the headers from the start of the retarget period of the anchor, or of
+// height if it's lower, up to the anchor.
+func (hc *headerChain) fetchAnchor(cli BtcClient, height uint32) error {
+	start := hc.anchor.Height
+	if height < start {
+		start = height
+	}
+	start -= start % hc.blocksPerRetarget
+	headers, err := cli.GetBlockHeaders(start, hc.anchor.Height)
+	if err != nil {
+		return fmt.Errorf("failed to get headers from %d to %d: %v", start, hc.anchor.Height, err)
+	}
+	if len(headers) != int(hc.anchor.Height-start+1) {
+		return fmt.Errorf("want %d headers from %d but got %d", hc.anchor.Height-start+1, start,
+			len(headers))
+	}
+
+	raw := make([][]byte, 0, len(headers))
+	for i, header := range headers {
+		if i > 0 && header.PrevBlock != headers[i-1].BlockHash() {
+			return fmt.Errorf("header %s at height %d is not linked to the previous one",
+				header.BlockHash().String(), start+uint32(i))
+		}
+		if err := checkProofOfWork(header, hc.netParam.PowLimit); err != nil {
+			return fmt.Errorf("header %s at height %d: %v", header.BlockHash().String(), start+uint32(i), err)
+		}
+		var buf bytes.Buffer
+		if err := header.Serialize(&buf); err != nil {
+			return fmt.Errorf("failed to serialize header: %v", err)
+		}
+		raw = append(raw, buf.Bytes())
+	}
+	hash := headers[len(headers)-1].BlockHash().String()
+	if hc.anchor.Hash == "" {
+		log.Warnf("[headerChain] no hash known for checkpoint %d, trust %s from the node",
+			hc.anchor.Height, hash)
+	} else if hash != hc.anchor.Hash {
+		return fmt.Errorf("checkpoint at height %d should be %s, but node returns %s", hc.anchor.Height,
+			hc.anchor.Hash, hash)
+	}
+
+	return hc.retryDB.PutBtcHeaders(start, raw)
+}
+
+// backfill validates the headers from start to end against the local chain and appends them.
+func (hc *headerChain) backfill(cli BtcClient, start, end uint32) error {
+	headers, err := cli.GetBlockHeaders(start, end)
+	if err != nil {
+		return fmt.Errorf("failed to get headers from %d to %d: %v", start, end, err)
+	}
+	if len(headers) != int(end-start+1) {
+		return fmt.Errorf("want %d headers from %d but got %d", end-start+1, start, len(headers))
+	}
+
+	// the headers not stored yet are looked up from the batch
+	lookup := func(height uint32) *wire.BlockHeader {
+		if height >= start && height <= end {
+			return headers[height-start]
+		}
+		return hc.get(height)
+	}
+	raw := make([][]byte, 0, len(headers))
+	for i, header := range headers {
+		height := start + uint32(i)
+		if err := hc.check(header, height, lookup); err != nil {
+			return fmt.Errorf("header at height %d: %v", height, err)
+		}
+		if height == hc.checkpoint.Height && hc.checkpoint.Hash != "" &&
+			header.BlockHash().String() != hc.checkpoint.Hash {
+			return fmt.Errorf("checkpoint at height %d should be %s, but node returns %s", height,
+				hc.checkpoint.Hash, header.BlockHash().String())
+		}
+		var buf bytes.Buffer
+		if err := header.Serialize(&buf); err != nil {
+			return fmt.Errorf("failed to serialize header: %v", err)
+		}
+		raw = append(raw, buf.Bytes())
+	}
+
+	return hc.retryDB.PutBtcHeaders(start, raw)
+}
+
+func (hc *headerChain) get(height uint32) *wire.BlockHeader {
+	raw := hc.retryDB.GetBtcHeader(height)
+	if raw == nil {
+		return nil
+	}
+	header := &wire.BlockHeader{}
+	if err := header.Deserialize(bytes.NewBuffer(raw)); err != nil {
+		log.Errorf("[headerChain] failed to decode header at height %d: %v", height, err)
+		return nil
+	}
+	return header
+}
+
+// validate checks the linkage, proof of work and difficulty of the header at height against
+// the local header chain. Headers already in the chain must match exactly.
+func (hc *headerChain) validate(header *wire.BlockHeader, height uint32) error {
+	hash := header.BlockHash()
+	if stored := hc.get(height); stored != nil {
+		if stored.BlockHash() != hash {
+			return fmt.Errorf("block %s conflicts with header %s in local chain", hash.String(),
+				stored.BlockHash().String())
+		}
+		return nil
+	}
+	return hc.check(header, height, hc.get)
+}
+
+// check validates a header not in the local chain, looking up the previous ones with lookup.
+func (hc *headerChain) check(header *wire.BlockHeader, height uint32, lookup func(uint32) *wire.BlockHeader) error {
+	hash := header.BlockHash()
+	prev := lookup(height - 1)
+	if prev == nil {
+		return fmt.Errorf("no header at height %d in local chain", height-1)
+	}
+	if header.PrevBlock != prev.BlockHash() {
+		return fmt.Errorf("block %s is not linked to %s", hash.String(), prev.BlockHash().String())
+	}
+	if err := checkProofOfWork(header, hc.netParam.PowLimit); err != nil {
+		return fmt.Errorf("block %s: %v", hash.String(), err)
+	}
+	bits, err := hc.requiredBits(prev, height-1, header.Timestamp, lookup)
+	if err != nil {
+		return err
+	}
+	if header.Bits != bits {
+		return fmt.Errorf("block %s has difficulty bits %08x, but %08x is required", hash.String(),
+			header.Bits, bits)
+	}
+
+	return nil
+}
+
+// put appends the header at height to the local chain, it must be validated first.
+func (hc *headerChain) put(header *wire.BlockHeader, height uint32) error {
+	var buf bytes.Buffer
+	if err := header.Serialize(&buf); err != nil {
+		return err
+	}
+	return hc.retryDB.PutBtcHeaders(height, [][]byte{buf.Bytes()})
+}
+
+// requiredBits follows the retarget rules of bitcoind for the block after prev. Regtest never
+// retargets.
+func (hc *headerChain) requiredBits(prev *wire.BlockHeader, prevHeight uint32, ts time.Time,
+	lookup func(uint32) *wire.BlockHeader) (uint32, error) {
+	if hc.netParam.Name == chaincfg.RegressionNetParams.Name {
+		return prev.Bits, nil
+	}
+	if (prevHeight+1)%hc.blocksPerRetarget != 0 {
+		if !hc.netParam.ReduceMinDifficulty {
+			return prev.Bits, nil
+		}
+		if ts.Unix() > prev.Timestamp.Unix()+int64(hc.netParam.MinDiffReductionTime/time.Second) {
+			return hc.netParam.PowLimitBits, nil
+		}
+		// the difficulty of the last block not mined under the min difficulty rule
+		h, header := prevHeight, prev
+		for h%hc.blocksPerRetarget != 0 && header.Bits == hc.netParam.PowLimitBits {
+			h--
+			if header = lookup(h); header == nil {
+				return 0, fmt.Errorf("no header at height %d in local chain", h)
+			}
+		}
+		return header.Bits, nil
+	}
+
+	first := lookup(prevHeight + 1 - hc.blocksPerRetarget)
+	if first == nil {
+		return 0, fmt.Errorf("no header at height %d in local chain", prevHeight+1-hc.blocksPerRetarget)
+	}
+	timespan := prev.Timestamp.Unix() - first.Timestamp.Unix()
+	if timespan < hc.minTimespan {
+		timespan = hc.minTimespan
+	} else if timespan > hc.maxTimespan {
+		timespan = hc.maxTimespan
+	}
+	target := blockchain.CompactToBig(prev.Bits)
+	target.Mul(target, big.NewInt(timespan))
+	target.Div(target, big.NewInt(int64(hc.netParam.TargetTimespan/time.Second)))
+	if target.Cmp(hc.netParam.PowLimit) > 0 {
+		target.Set(hc.netParam.PowLimit)
+	}
+
+	return blockchain.BigToCompact(target), nil
+}
+
+func checkProofOfWork(header *wire.BlockHeader, powLimit *big.Int) error {
+	target := blockchain.CompactToBig(header.Bits)
+	if target.Sign() <= 0 {
+		return fmt.Errorf("target %064x is not positive", target)
+	}
+	if target.Cmp(powLimit) > 0 {
+		return fmt.Errorf("target %064x is higher than the limit %064x", target, powLimit)
+	}
+	hash := header.BlockHash()
+	if blockchain.HashToBig(&hash).Cmp(target) > 0 {
+		return fmt.Errorf("hash %s is higher than the target %064x", hash.String(), target)
+	}
+	return nil
+}
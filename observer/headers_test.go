@@ -0,0 +1,65 @@
+package observer
+
+import (
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ontio/btcrelayer/db"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHeaderChain_RequiredBits(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "headers")
+	defer os.RemoveAll(dir)
+	rdb, err := db.NewRetryDB(dir, 1, 1, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc, err := newHeaderChain(&chaincfg.MainNetParams, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hc.anchor.Height != 560000 || hc.anchor.Hash == "" {
+		t.Fatalf("should anchor at the latest btcd checkpoint, not %d %s", hc.anchor.Height, hc.anchor.Hash)
+	}
+	first := &wire.BlockHeader{Bits: 0x1d00ffff, Timestamp: time.Unix(1500000000, 0)}
+	if err = hc.put(first, 2016); err != nil {
+		t.Fatal(err)
+	}
+
+	prev := &wire.BlockHeader{Bits: 0x1d00ffff, Timestamp: first.Timestamp.Add(chaincfg.MainNetParams.TargetTimespan)}
+	if bits, _ := hc.requiredBits(prev, 4000, prev.Timestamp, hc.get); bits != prev.Bits {
+		t.Fatalf("should keep the bits in a period, got %08x", bits)
+	}
+	if bits, _ := hc.requiredBits(prev, 4031, prev.Timestamp, hc.get); bits != 0x1d00ffff {
+		t.Fatalf("should keep the bits on target timespan, got %08x", bits)
+	}
+	prev.Timestamp = first.Timestamp.Add(time.Hour)
+	if bits, _ := hc.requiredBits(prev, 4031, prev.Timestamp, hc.get); bits != 0x1c3fffc0 {
+		t.Fatalf("should rise to 4x difficulty at most, got %08x", bits)
+	}
+	if _, err = hc.requiredBits(prev, 6047, prev.Timestamp, hc.get); err == nil {
+		t.Fatal("should fail without the first header of the period")
+	}
+}
+
+func TestHeaderChain_Checkpoints(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "headers")
+	defer os.RemoveAll(dir)
+	rdb, err := db.NewRetryDB(dir, 1, 1, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, netType := range []string{"test", "sim", "regtest", ""} {
+		if _, err = newHeaderChain(getNetParam(netType), rdb); err != nil {
+			t.Fatalf("net %q: %v", netType, err)
+		}
+	}
+	unknown := chaincfg.SimNetParams
+	unknown.Name = "unknown"
+	if _, err = newHeaderChain(&unknown, rdb); err == nil {
+		t.Fatal("should fail without a checkpoint")
+	}
+}
@@ -0,0 +1,146 @@
+package observer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ontio/btcrelayer/db"
+	"github.com/ontio/btcrelayer/log"
+	"time"
+)
+
+// MempoolObserver records deposits as pending as soon as they show up in the mempool, so
+// users can follow them before they confirm. It never relays anything, BtcObserver marks
+// the pending deposits confirmed when it finds them in blocks. The records are pruned once
+// they're older than btc_pending_expiry hours, which defaults to the mempool expiry of
+// bitcoind, so evicted deposits don't pile up.
+type MempoolObserver struct {
+	cli     BtcClient
+	conf    *BtcObConfig
+	retryDB *db.RetryDB
+	fed     *federation
+	zmq     *ZmqSubscriber
+	seen    map[string]bool
+	height  uint32
+	pruned  time.Time
+}
+
+// defaultPendingExpiry is the default -mempoolexpiry of bitcoind in hours.
+const defaultPendingExpiry = 336
+
+func NewMempoolObserver(conf *BtcObConfig, cli BtcClient, rdb *db.RetryDB) (*MempoolObserver, error) {
+	fed, err := newFederation(conf.FederationScripts, getNetParam(conf.NetType))
+	if err != nil {
+		return nil, fmt.Errorf("failed to new federation: %v", err)
+	}
+
+	observer := &MempoolObserver{
+		cli:     cli,
+		conf:    conf,
+		retryDB: rdb,
+		fed:     fed,
+		seen:    make(map[string]bool),
+	}
+	if conf.BtcZmqAddress != "" {
+		observer.zmq = NewZmqSubscriber(conf.BtcZmqAddress, ZMQ_RAWTX)
+	}
+
+	return observer, nil
+}
+
+func (observer *MempoolObserver) Listen() {
+	log.Infof("[MempoolObserver] start watching mempool, check once %d seconds", observer.conf.BtcObLoopWaitTime)
+
+	var txs <-chan *ZmqMsg
+	if observer.zmq != nil {
+		observer.zmq.Start()
+		txs = observer.zmq.Messages()
+	}
+
+	tick := time.NewTicker(time.Duration(observer.conf.BtcObLoopWaitTime) * time.Second)
+	for {
+		select {
+		case <-tick.C:
+			if err := observer.poll(); err != nil {
+				log.Errorf("[MempoolObserver] failed to poll mempool, loop continue: %v", err)
+			}
+			if time.Since(observer.pruned) > time.Hour {
+				observer.prune()
+			}
+		case msg := <-txs:
+			mtx := wire.NewMsgTx(wire.TxVersion)
+			if err := mtx.BtcDecode(bytes.NewBuffer(msg.Body), wire.ProtocolVersion, wire.LatestEncoding); err != nil {
+				log.Errorf("[MempoolObserver] failed to decode tx from zmq: %v", err)
+				continue
+			}
+			observer.seen[mtx.TxHash().String()] = true
+			observer.check(mtx)
+		}
+	}
+}
+
+func (observer *MempoolObserver) poll() error {
+	height, _, err := observer.cli.GetCurrentHeightAndHash()
+	if err != nil {
+		return err
+	}
+	observer.height = height
+
+	txids, err := observer.cli.GetRawMempool()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(txids))
+	for _, txid := range txids {
+		if observer.seen[txid] {
+			seen[txid] = true
+			continue
+		}
+		mtx, err := observer.cli.GetRawTransaction(txid)
+		if err != nil {
+			// the tx may be mined or evicted after getrawmempool, try it next round
+			log.Debugf("[MempoolObserver] failed to get tx %s: %v", txid, err)
+			continue
+		}
+		seen[txid] = true
+		observer.check(mtx)
+	}
+	observer.seen = seen
+
+	return nil
+}
+
+func (observer *MempoolObserver) check(mtx *wire.MsgTx) {
+	// a tx in the mempool goes to the next block at the earliest
+	if !checkIfCrossChainTx(mtx, observer.fed, observer.height+1) {
+		return
+	}
+	txid := mtx.TxHash().String()
+	err := observer.retryDB.PutPendingDeposit(&db.PendingDeposit{
+		Txid:      txid,
+		Value:     mtx.TxOut[0].Value,
+		FirstSeen: time.Now().Unix(),
+	})
+	if err != nil {
+		log.Errorf("[MempoolObserver] failed to record pending deposit %s: %v", txid, err)
+		return
+	}
+	log.Debugf("[MempoolObserver] pending deposit %s found in mempool, value: %d", txid, mtx.TxOut[0].Value)
+}
+
+// prune deletes the pending deposits seen longer ago than the expiry.
+func (observer *MempoolObserver) prune() {
+	expiry := observer.conf.BtcPendingExpiry
+	if expiry <= 0 {
+		expiry = defaultPendingExpiry
+	}
+	n, err := observer.retryDB.PrunePendingDeposits(time.Now().Add(-time.Duration(expiry) * time.Hour).Unix())
+	if err != nil {
+		log.Errorf("[MempoolObserver] failed to prune pending deposits: %v", err)
+		return
+	}
+	observer.pruned = time.Now()
+	if n > 0 {
+		log.Infof("[MempoolObserver] pruned %d pending deposits seen more than %d hours ago", n, expiry)
+	}
+}
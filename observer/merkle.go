@@ -0,0 +1,112 @@
+package observer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+type partialMerkleTree struct {
+	leaves  []*chainhash.Hash
+	matches []bool
+	bits    []bool
+	hashes  []*chainhash.Hash
+}
+
+func (tree *partialMerkleTree) calcTreeWidth(height uint32) uint32 {
+	return (uint32(len(tree.leaves)) + (1 << height) - 1) >> height
+}
+
+func (tree *partialMerkleTree) calcHash(height, pos uint32) *chainhash.Hash {
+	if height == 0 {
+		return tree.leaves[pos]
+	}
+	left := tree.calcHash(height-1, pos*2)
+	right := left
+	if pos*2+1 < tree.calcTreeWidth(height-1) {
+		right = tree.calcHash(height-1, pos*2+1)
+	}
+	return blockchain.HashMerkleBranches(left, right)
+}
+
+func (tree *partialMerkleTree) traverseAndBuild(height, pos uint32) {
+	isParent := false
+	for p := pos << height; p < (pos+1)<<height && p < uint32(len(tree.leaves)); p++ {
+		if tree.matches[p] {
+			isParent = true
+			break
+		}
+	}
+	tree.bits = append(tree.bits, isParent)
+
+	if height == 0 || !isParent {
+		tree.hashes = append(tree.hashes, tree.calcHash(height, pos))
+		return
+	}
+	tree.traverseAndBuild(height-1, pos*2)
+	if pos*2+1 < tree.calcTreeWidth(height-1) {
+		tree.traverseAndBuild(height-1, pos*2+1)
+	}
+}
+
+func newMerkleBlock(header *wire.BlockHeader, leaves []*chainhash.Hash, matches []bool) *wire.MsgMerkleBlock {
+	tree := &partialMerkleTree{
+		leaves:  leaves,
+		matches: matches,
+	}
+	height := uint32(0)
+	for tree.calcTreeWidth(height) > 1 {
+		height++
+	}
+	tree.traverseAndBuild(height, 0)
+
+	mb := wire.NewMsgMerkleBlock(header)
+	mb.Transactions = uint32(len(leaves))
+	mb.Hashes = tree.hashes
+	mb.Flags = make([]byte, (len(tree.bits)+7)/8)
+	for i, bit := range tree.bits {
+		if bit {
+			mb.Flags[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return mb
+}
+
+// BuildMerkleProof proves txids are included in block with a partial merkle tree. The result is
+// serialized the same as the one returned by gettxoutproof.
+func BuildMerkleProof(block *wire.MsgBlock, txids []chainhash.Hash) ([]byte, error) {
+	leaves := make([]*chainhash.Hash, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		txid := tx.TxHash()
+		leaves[i] = &txid
+	}
+	return buildMerkleProof(&block.Header, leaves, txids)
+}
+
+func buildMerkleProof(header *wire.BlockHeader, leaves []*chainhash.Hash, txids []chainhash.Hash) ([]byte, error) {
+	if len(leaves) == 0 {
+		return nil, fmt.Errorf("no transaction in block %s", header.BlockHash().String())
+	}
+	matches := make([]bool, len(leaves))
+	for _, txid := range txids {
+		found := false
+		for i, leaf := range leaves {
+			if leaf.IsEqual(&txid) {
+				matches[i] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("tx %s not found in block %s", txid.String(), header.BlockHash().String())
+		}
+	}
+
+	var buf bytes.Buffer
+	err := newMerkleBlock(header, leaves, matches).BtcEncode(&buf, wire.ProtocolVersion, wire.LatestEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode merkle block: %v", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,58 @@
+package observer
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"testing"
+)
+
+func TestBuildMerkleProof(t *testing.T) {
+	genesis := chaincfg.MainNetParams.GenesisBlock
+	proof, err := BuildMerkleProof(genesis, []chainhash.Hash{genesis.Transactions[0].TxHash()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a29ab5f49ffff001d1dac2b7c01000000013ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a0101"
+	if hex.EncodeToString(proof) != expected {
+		t.Fatalf("wrong proof for genesis: %x", proof)
+	}
+
+	// block 000000000003ba27aa200b1cecaad478d2b00432346c3f1f3986da1afd33e506 at height 100000
+	hb, _ := hex.DecodeString("0100000050120119172a610421a6c3011dd330d9df07b63616c2cc1f1cd00200000000006657a9252aacd5c0b2940996ecff952228c3067cc38d4885efb5a4ac4247e9f337221b4d4c86041b0f2b5710")
+	header := &wire.BlockHeader{}
+	if err = header.Deserialize(bytes.NewBuffer(hb)); err != nil {
+		t.Fatal(err)
+	}
+	leaves := make([]*chainhash.Hash, 0)
+	for _, id := range []string{
+		"8c14f0db3df150123e6f3dbbf30f8b955a8249b62ac1d1ff16284aefa3d06d87",
+		"fff2525b8931402dd09222c50775608f75787bd2b87e56995a7bdd30f79702c4",
+		"6359f0868171b1d194cbee1af2f16ea598ae8fad666d9b012c8ed2b79a236ec4",
+		"e9a66845e05d5abc0ad04ec80f774a7e585c6e8db975962d069a522137b80c1d",
+	} {
+		h, _ := chainhash.NewHashFromStr(id)
+		leaves = append(leaves, h)
+	}
+	for _, c := range []struct {
+		idx   int
+		proof string
+	}{
+		{1, "0100000050120119172a610421a6c3011dd330d9df07b63616c2cc1f1cd00200000000006657a9252aacd5c0b2940996ecff952228c3067cc38d4885efb5a4ac4247e9f337221b4d4c86041b0f2b57100400000003876dd0a3ef4a2816ffd1c12ab649825a958b0ff3bb3d6f3e1250f13ddbf0148cc40297f730dd7b5a99567eb8d27b78758f607507c52292d02d4031895b52f2ff49aef42d78e3e9999c9e6ec9e1dddd6cb880bf3b076a03be1318ca789089308e010b"},
+		{2, "0100000050120119172a610421a6c3011dd330d9df07b63616c2cc1f1cd00200000000006657a9252aacd5c0b2940996ecff952228c3067cc38d4885efb5a4ac4247e9f337221b4d4c86041b0f2b5710040000000315b88c5107195bf09eb9da89b83d95b3d070079a3c5c5d3d17d0dcd873fbdaccc46e239ab7d28e2c019b6d66ad8fae98a56ef1f21aeecb94d1b1718186f059631d0cb83721529a062d9675b98d6e5c587e4a770fc84ed00abc5a5de04568a6e9010d"},
+	} {
+		proof, err = buildMerkleProof(header, leaves, []chainhash.Hash{*leaves[c.idx]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(proof) != c.proof {
+			t.Fatalf("wrong proof for no%d tx: %x", c.idx, proof)
+		}
+	}
+
+	if _, err = buildMerkleProof(header, leaves, []chainhash.Hash{{0x01}}); err == nil {
+		t.Fatal("err should not be nil")
+	}
+}
@@ -0,0 +1,306 @@
+package observer
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ontio/btcrelayer/log"
+	"sync"
+	"time"
+)
+
+const maxBackoffFailures = 6
+
+type BtcEndpoint struct {
+	Address string `json:"address"`
+	User    string `json:"user"`
+	Pwd     string `json:"pwd"`
+}
+
+type btcEndpoint struct {
+	name        string
+	cli         BtcClient
+	failures    int
+	lastFailure time.Time
+}
+
+// healthy tells if the endpoint can be tried first. An endpoint failed n times in a row is put
+// back after n*SleepTime seconds.
+func (ep *btcEndpoint) healthy(now time.Time) bool {
+	if ep.failures == 0 {
+		return true
+	}
+	n := ep.failures
+	if n > maxBackoffFailures {
+		n = maxBackoffFailures
+	}
+	return now.Sub(ep.lastFailure) > time.Duration(n)*SleepTime*time.Second
+}
+
+// MultiCli spreads the calls over several nodes. Calls go to the healthy nodes in configured
+// order and fail over to the next one on error. With quorum > 1, a block is only returned when
+// at least quorum nodes agree on its hash.
+type MultiCli struct {
+	lock      sync.Mutex
+	endpoints []*btcEndpoint
+	quorum    int
+}
+
+func NewMultiCli(names []string, clis []BtcClient, quorum int) (*MultiCli, error) {
+	if len(clis) == 0 || len(names) != len(clis) {
+		return nil, fmt.Errorf("need same number of names and clients, got %d and %d", len(names), len(clis))
+	}
+	if quorum > len(clis) {
+		return nil, fmt.Errorf("quorum %d is more than the %d endpoints", quorum, len(clis))
+	}
+	m := &MultiCli{
+		endpoints: make([]*btcEndpoint, len(clis)),
+		quorum:    quorum,
+	}
+	for i, cli := range clis {
+		m.endpoints[i] = &btcEndpoint{
+			name: names[i],
+			cli:  cli,
+		}
+	}
+	return m, nil
+}
+
+// order returns the healthy endpoints followed by the unhealthy ones.
+func (m *MultiCli) order() []*btcEndpoint {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	healthy := make([]*btcEndpoint, 0, len(m.endpoints))
+	unhealthy := make([]*btcEndpoint, 0)
+	for _, ep := range m.endpoints {
+		if ep.healthy(now) {
+			healthy = append(healthy, ep)
+		} else {
+			unhealthy = append(unhealthy, ep)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (m *MultiCli) report(ep *btcEndpoint, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err == nil {
+		if ep.failures > 0 {
+			log.Infof("[MultiCli] endpoint %s is back", ep.name)
+		}
+		ep.failures = 0
+		return
+	}
+	ep.failures++
+	ep.lastFailure = time.Now()
+}
+
+// noQuorumErr means the data from an endpoint is not agreed by enough others. It's not taken
+// as a failure of the endpoint, the ones disagreeing are charged once a quorum is reached.
+type noQuorumErr struct {
+	Err error
+}
+
+func (err noQuorumErr) Error() string {
+	return err.Err.Error()
+}
+
+// try calls f on the endpoints in order until one succeeds. NeedToRetryErr and TxInChainErr
+// are the node's decision on a tx, so they're returned without failing over. A tx not found
+// on one node may be found on another, but the node is not taken as failed.
+func (m *MultiCli) try(method string, f func(ep *btcEndpoint) error) error {
+	var err error
+	for _, ep := range m.order() {
+		err = f(ep)
+		switch err.(type) {
+		case NeedToRetryErr, TxInChainErr:
+			return err
+		case noQuorumErr, TxNotFoundErr:
+		default:
+			m.report(ep, err)
+		}
+		if err == nil {
+			return nil
+		}
+		log.Warnf("[MultiCli] %s failed on endpoint %s, fail over: %v", method, ep.name, err)
+	}
+	return err
+}
+
+// confirm checks if at least quorum nodes, including the one it comes from, have the block
+// hash at height. Once they do, the nodes having another block are reported as failed.
+func (m *MultiCli) confirm(height uint32, hash string, from *btcEndpoint) error {
+	if m.quorum <= 1 {
+		return nil
+	}
+	agreed := 1
+	disagreed := make([]*btcEndpoint, 0)
+	for _, ep := range m.order() {
+		if ep == from {
+			continue
+		}
+		h, err := ep.cli.GetBlockHash(height)
+		if err != nil {
+			m.report(ep, err)
+			log.Warnf("[MultiCli] failed to get hash at height %d from endpoint %s: %v", height, ep.name, err)
+			continue
+		}
+		if h != hash {
+			log.Warnf("[MultiCli] endpoint %s has block %s at height %d, but %s has %s", ep.name, h, height,
+				from.name, hash)
+			disagreed = append(disagreed, ep)
+			continue
+		}
+		m.report(ep, nil)
+		if agreed++; agreed >= m.quorum {
+			for _, d := range disagreed {
+				m.report(d, fmt.Errorf("disagree on block at height %d", height))
+			}
+			return nil
+		}
+	}
+	return noQuorumErr{fmt.Errorf("only %d of %d endpoints agree on block %s at height %d", agreed, m.quorum,
+		hash, height)}
+}
+
+// confirmRange confirms the blocks from start by the hash of the last one, the others are
+// bound to it by their links. It returns how many blocks are confirmed, which are fewer than
+// given together with an error if some block is not linked to the previous one.
+func (m *MultiCli) confirmRange(start uint32, blocks []*wire.MsgBlock, hashes []string, from *btcEndpoint) (
+	int, error) {
+	var linkErr error
+	n := len(blocks)
+	for i, block := range blocks {
+		if block.BlockHash().String() != hashes[i] || i > 0 && block.Header.PrevBlock != blocks[i-1].BlockHash() {
+			linkErr = fmt.Errorf("block %s at height %d is not linked to the previous one", hashes[i],
+				start+uint32(i))
+			n = i
+			break
+		}
+	}
+	if n == 0 {
+		return 0, linkErr
+	}
+	if err := m.confirm(start+uint32(n-1), hashes[n-1], from); err != nil {
+		return 0, err
+	}
+	return n, linkErr
+}
+
+func (m *MultiCli) GetCurrentHeightAndHash() (height uint32, hash string, err error) {
+	err = m.try("GetCurrentHeightAndHash", func(ep *btcEndpoint) error {
+		height, hash, err = ep.cli.GetCurrentHeightAndHash()
+		return err
+	})
+	return
+}
+
+func (m *MultiCli) GetChainInfo() (info *ChainInfo, err error) {
+	err = m.try("GetChainInfo", func(ep *btcEndpoint) error {
+		info, err = ep.cli.GetChainInfo()
+		return err
+	})
+	return
+}
+
+func (m *MultiCli) GetBlockHash(height uint32) (hash string, err error) {
+	err = m.try("GetBlockHash", func(ep *btcEndpoint) error {
+		if hash, err = ep.cli.GetBlockHash(height); err != nil {
+			return err
+		}
+		return m.confirm(height, hash, ep)
+	})
+	return
+}
+
+func (m *MultiCli) GetBlockByHeight(height uint32) (block *wire.MsgBlock, hash string, err error) {
+	err = m.try("GetBlockByHeight", func(ep *btcEndpoint) error {
+		if block, hash, err = ep.cli.GetBlockByHeight(height); err != nil {
+			return err
+		}
+		return m.confirm(height, hash, ep)
+	})
+	return
+}
+
+func (m *MultiCli) GetBlocksByHeightRange(start, end uint32) (blocks []*wire.MsgBlock, hashes []string, err error) {
+	err = m.try("GetBlocksByHeightRange", func(ep *btcEndpoint) error {
+		if blocks, hashes, err = ep.cli.GetBlocksByHeightRange(start, end); err != nil {
+			return err
+		}
+		if len(blocks) == 0 {
+			return nil
+		}
+		n, err := m.confirmRange(start, blocks, hashes, ep)
+		blocks, hashes = blocks[:n], hashes[:n]
+		return err
+	})
+	return
+}
+
+func (m *MultiCli) GetBlockHeaders(start, end uint32) (headers []*wire.BlockHeader, err error) {
+	err = m.try("GetBlockHeaders", func(ep *btcEndpoint) error {
+		headers, err = ep.cli.GetBlockHeaders(start, end)
+		return err
+	})
+	return
+}
+
+func (m *MultiCli) GetTxsInBlockByHeight(height uint32) (txns []*wire.MsgTx, hash string, err error) {
+	err = m.try("GetTxsInBlockByHeight", func(ep *btcEndpoint) error {
+		if txns, hash, err = ep.cli.GetTxsInBlockByHeight(height); err != nil {
+			return err
+		}
+		return m.confirm(height, hash, ep)
+	})
+	return
+}
+
+func (m *MultiCli) GetProof(txids []string) (proof string, err error) {
+	err = m.try("GetProof", func(ep *btcEndpoint) error {
+		proof, err = ep.cli.GetProof(txids)
+		return err
+	})
+	return
+}
+
+func (m *MultiCli) BroadcastTx(tx string) (txid string, err error) {
+	err = m.try("BroadcastTx", func(ep *btcEndpoint) error {
+		txid, err = ep.cli.BroadcastTx(tx)
+		return err
+	})
+	return
+}
+
+func (m *MultiCli) GetRawMempool() (txids []string, err error) {
+	err = m.try("GetRawMempool", func(ep *btcEndpoint) error {
+		txids, err = ep.cli.GetRawMempool()
+		return err
+	})
+	return
+}
+
+func (m *MultiCli) GetRawTransaction(txid string) (mtx *wire.MsgTx, err error) {
+	err = m.try("GetRawTransaction", func(ep *btcEndpoint) error {
+		mtx, err = ep.cli.GetRawTransaction(txid)
+		return err
+	})
+	return
+}
+
+func (m *MultiCli) GetTxConfirmations(txid string) (confs uint32, err error) {
+	err = m.try("GetTxConfirmations", func(ep *btcEndpoint) error {
+		confs, err = ep.cli.GetTxConfirmations(txid)
+		return err
+	})
+	return
+}
+
+func (m *MultiCli) GetScriptPubKey(txid string, index uint32) (spk string, err error) {
+	err = m.try("GetScriptPubKey", func(ep *btcEndpoint) error {
+		spk, err = ep.cli.GetScriptPubKey(txid, index)
+		return err
+	})
+	return
+}
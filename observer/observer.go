@@ -3,11 +3,18 @@ package observer
 import (
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/ontio/btcrelayer/db"
 	"github.com/ontio/btcrelayer/log"
-	sdk "github.com/ontio/multi-chain-go-sdk"
+	sdkcom "github.com/ontio/multi-chain-go-sdk/common"
+	"github.com/ontio/multi-chain/native/service/utils"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,161 +26,575 @@ type BtcObConfig struct {
 	User               string `json:"user"`
 	Pwd                string `json:"pwd"`
 	WaitingCycle       uint32 `json:"waiting_cycle"`
+	BtcObBatchSize     uint32 `json:"btc_ob_batch_size"`
+	BtcObFetchWorkers  int    `json:"btc_ob_fetch_workers"`
+	BtcZmqAddress      string `json:"btc_zmq_address"`
+	BtcBackend         string `json:"btc_backend"`
+	EsploraAddress     string `json:"esplora_address"`
+	BtcMempoolWatch    bool   `json:"btc_mempool_watch"`
+	BtcPendingExpiry   int64  `json:"btc_pending_expiry"` // hours, 336 if 0
+	BtcQuorum          int    `json:"btc_quorum"`
+
+	BtcEndpoints      []*BtcEndpoint      `json:"btc_endpoints"`
+	FederationScripts []*FederationScript `json:"federation_scripts"`
+	DepositPolicy     *DepositPolicy      `json:"deposit_policy"`
 }
 
 type BtcObserver struct {
-	cli      *RestCli
+	cli      BtcClient
 	NetParam *chaincfg.Params
 	conf     *BtcObConfig
 	retryDB  *db.RetryDB
+	fetcher  *blockFetcher
+	zmq      *ZmqSubscriber
+	fed      *federation
+	headers  *headerChain
+	status   atomic.Value
 }
 
-func NewBtcObserver(conf *BtcObConfig, cli *RestCli, rdb *db.RetryDB) *BtcObserver {
-	var param *chaincfg.Params
-	switch conf.NetType {
+func getNetParam(netType string) *chaincfg.Params {
+	switch netType {
 	case "test":
-		param = &chaincfg.TestNet3Params
+		return &chaincfg.TestNet3Params
 	case "sim":
-		param = &chaincfg.SimNetParams
+		return &chaincfg.SimNetParams
 	case "regtest":
-		param = &chaincfg.RegressionNetParams
+		return &chaincfg.RegressionNetParams
 	default:
-		param = &chaincfg.MainNetParams
+		return &chaincfg.MainNetParams
+	}
+}
+
+func NewBtcObserver(conf *BtcObConfig, cli BtcClient, rdb *db.RetryDB) (*BtcObserver, error) {
+	param := getNetParam(conf.NetType)
+	fed, err := newFederation(conf.FederationScripts, param)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new federation: %v", err)
+	}
+
+	headers, err := newHeaderChain(param, rdb)
+	if err != nil {
+		return nil, err
 	}
+
 	var observer BtcObserver
 	observer.cli = cli
 	observer.NetParam = param
 	observer.conf = conf
 	observer.retryDB = rdb
+	observer.fed = fed
+	observer.headers = headers
+	observer.fetcher = newBlockFetcher(cli, conf.BtcObFetchWorkers, conf.BtcObBatchSize)
+	if conf.BtcZmqAddress != "" {
+		observer.zmq = NewZmqSubscriber(conf.BtcZmqAddress, ZMQ_HASHBLOCK, ZMQ_RAWBLOCK)
+	}
 
-	return &observer
+	return &observer, nil
 }
 
+// Listen scans btc blocks for deposits. The deposits of a block are put into the relay queue
+// together with the cursor, and stay there until the relayer confirms they're imported, so
+// they're relayed again after a restart.
 func (observer *BtcObserver) Listen(relaying chan *CrossChainItem) {
 	top := observer.retryDB.GetBtcHeight()
 	if top < btcCheckPoints[observer.NetParam.Name].Height {
 		top = btcCheckPoints[observer.NetParam.Name].Height
 	}
+
+	queued, err := observer.retryDB.GetRelayQueue()
+	if err != nil {
+		log.Errorf("[BtcObserver] failed to get deposits in relay queue: %v", err)
+	}
+	if len(queued) > 0 {
+		log.Infof("[BtcObserver] resume %d deposits from relay queue", len(queued))
+	}
+	for _, d := range queued {
+		item, err := queuedItem(d)
+		if err != nil {
+			log.Errorf("[BtcObserver] wrong deposit %s in relay queue: %v", d.Txid, err)
+			continue
+		}
+		relaying <- item
+	}
 	log.Infof("[BtcObserver] get start height %d from checkpoint, check once %d seconds", top, observer.conf.BtcObLoopWaitTime)
 
+	var wake <-chan *ZmqMsg
+	if observer.zmq != nil {
+		observer.zmq.Start()
+		wake = observer.zmq.Messages()
+	}
+
 	tick := time.NewTicker(time.Duration(observer.conf.BtcObLoopWaitTime) * time.Second)
 	for {
 		select {
 		case <-tick.C:
-			newTop, hash, err := observer.cli.GetCurrentHeightAndHash()
+		case msg := <-wake:
+			log.Tracef("[BtcObserver] woken up by zmq %s notification", msg.Topic)
+		}
+		if !observer.checkSynced() {
+			continue
+		}
+		newTop, hash, err := observer.cli.GetCurrentHeightAndHash()
+		if err != nil {
+			log.Errorf("[BtcObserver] GetCurrentHeightAndHash failed, loop continue: %v", err)
+			continue
+		}
+		log.Tracef("[BtcObserver] start observing from block %s at height %d", hash, newTop)
+
+		fork, err := observer.findForkPoint(top - observer.conf.BtcObConfirmations + 1)
+		if err != nil {
+			log.Errorf("[BtcObserver] failed to check reorg, loop continue: %v", err)
+			continue
+		}
+		if fork+observer.conf.BtcObConfirmations-1 < top {
+			top, err = observer.rollback(fork, top)
 			if err != nil {
-				log.Errorf("[BtcObserver] GetCurrentHeightAndHash failed, loop continue: %v", err)
+				log.Errorf("[BtcObserver] failed to rollback to fork point %d, loop continue: %v", fork, err)
 				continue
 			}
-			log.Tracef("[BtcObserver] start observing from block %s at height %d", hash, newTop)
+		}
 
-			if newTop <= top { // Prevent rollback
-				log.Tracef("[BtcObserver] height not enough: now is %d, prev is %d", newTop, top)
-				continue
+		// the header of the last scanned block is needed to validate the next one
+		if err := observer.headers.bootstrap(observer.cli, top-observer.conf.BtcObConfirmations+1); err != nil {
+			log.Errorf("[BtcObserver] failed to bootstrap header chain, loop continue: %v", err)
+			continue
+		}
+		if newTop <= top { // Prevent rollback
+			log.Tracef("[BtcObserver] height not enough: now is %d, prev is %d", newTop, top)
+			continue
+		}
+		scanned, total := observer.scan(top-observer.conf.BtcObConfirmations+1,
+			newTop-observer.conf.BtcObConfirmations+1, relaying)
+		if total > 0 {
+			log.Infof("[BtcObserver] total %d deposits found this time", total)
+		}
+		top = scanned + observer.conf.BtcObConfirmations - 1
+		log.Tracef("[BtcObserver] write btc height %d", top)
+	}
+}
+
+func (observer *BtcObserver) checkSynced() bool {
+	info, err := observer.cli.GetChainInfo()
+	if err != nil {
+		log.Errorf("[BtcObserver] GetChainInfo failed, loop continue: %v", err)
+		observer.status.Store(fmt.Sprintf("unknown: %v", err))
+		return false
+	}
+	if !info.IsSynced() {
+		status := fmt.Sprintf("syncing: blocks %d, headers %d, initial block download %v", info.Blocks,
+			info.Headers, info.InitialBlockDownload)
+		log.Warnf("[BtcObserver] node is not synced, pause scanning: %s", status)
+		observer.status.Store(status)
+		return false
+	}
+	observer.status.Store(fmt.Sprintf("synced: blocks %d", info.Blocks))
+	return true
+}
+
+// Status tells whether the node is synced enough to scan.
+func (observer *BtcObserver) Status() string {
+	status, _ := observer.status.Load().(string)
+	return status
+}
+
+func (observer *BtcObserver) scan(scanned, end uint32, relaying chan *CrossChainItem) (uint32, int) {
+	quit := make(chan struct{})
+	defer close(quit)
+
+	total := 0
+	for res := range observer.fetcher.fetch(scanned, end, quit) {
+		for i, block := range res.blocks {
+			h := res.start + uint32(i)
+			if prev := observer.retryDB.GetBtcBlockHash(h - 1); prev != "" && prev != block.Header.PrevBlock.String() {
+				log.Warnf("[BtcObserver] block %s at height %d is not linked to %s, reorg happened while scanning",
+					res.hashes[i], h, prev)
+				return scanned, total
 			}
-			total := 0
-			for h := top - observer.conf.BtcObConfirmations + 2; h <= newTop-observer.conf.BtcObConfirmations+1; h++ {
-				txns, hash, err := observer.cli.GetTxsInBlockByHeight(h)
-				if err != nil {
-					log.Errorf("[BtcObserver] failed to check block %s, retry after 10 sec: %v", hash, err)
-					h--
-					<-time.Tick(time.Second * SleepTime)
-					continue
-				}
-				count := observer.SearchTxInBlock(txns, h, relaying)
-				if count > 0 {
-					total += count
-					log.Infof("[BtcObserver] %d tx found in block(height:%d) %s", count, h, hash)
-				}
+			if err := observer.headers.validate(&block.Header, h); err != nil {
+				log.Errorf("[BtcObserver] block %s at height %d failed header validation, refuse to scan: %v",
+					res.hashes[i], h, err)
+				return scanned, total
+			}
+			items, err := observer.findDeposits(block, h)
+			if err != nil {
+				log.Errorf("[BtcObserver] failed to search block %s at height %d, retry next round: %v",
+					res.hashes[i], h, err)
+				return scanned, total
+			}
+			// the header goes first, so a block committed is always in the header chain
+			if err := observer.headers.put(&block.Header, h); err != nil {
+				log.Errorf("[BtcObserver] failed to put header of block %s at height %d, retry next round: %v",
+					res.hashes[i], h, err)
+				return scanned, total
+			}
+			if err := observer.commitBlock(h, res.hashes[i], items, relaying); err != nil {
+				log.Errorf("[BtcObserver] failed to commit block %s at height %d, retry next round: %v",
+					res.hashes[i], h, err)
+				return scanned, total
+			}
+			if len(items) > 0 {
+				total += len(items)
+				log.Infof("[BtcObserver] %d tx found in block(height:%d) %s", len(items), h, res.hashes[i])
 			}
+			scanned = h
+		}
+		if res.err != nil {
+			log.Errorf("[BtcObserver] failed to get block at height %d, retry next round: %v", scanned+1, res.err)
+			return scanned, total
+		}
+	}
 
-			top = newTop
-			if total > 0 || top%observer.conf.WaitingCycle == 0 {
-				err := observer.retryDB.SetBtcHeight(top)
-				log.Tracef("[BtcObserver] write btc height %d", top)
-				if err != nil {
-					log.Errorf("[BtcObserver] failed to set btc height: %v", err)
-				}
+	return scanned, total
+}
+
+// Rescan searches the blocks in [from, to] for deposits again without touching the cursor. Only
+// blocks already in the local header chain are searched, the ones the observer hasn't scanned
+// yet are refused.
+func (observer *BtcObserver) Rescan(from, to uint32, relaying chan *CrossChainItem) error {
+	if from == 0 || from > to {
+		return fmt.Errorf("wrong range from %d to %d", from, to)
+	}
+	quit := make(chan struct{})
+	defer close(quit)
+
+	for res := range observer.fetcher.fetch(from-1, to, quit) {
+		for i, block := range res.blocks {
+			h := res.start + uint32(i)
+			if stored := observer.headers.get(h); stored == nil || stored.BlockHash() != block.BlockHash() {
+				return fmt.Errorf("block %s at height %d is not in local header chain", res.hashes[i], h)
+			}
+			count, err := observer.SearchTxInBlock(block, h, relaying)
+			if err != nil {
+				return fmt.Errorf("failed to search block %s at height %d: %v", res.hashes[i], h, err)
+			}
+			if count > 0 {
+				log.Infof("[BtcObserver] rescan: %d tx found in block(height:%d) %s", count, h, res.hashes[i])
 			}
 		}
+		if res.err != nil {
+			return fmt.Errorf("failed to get blocks from height %d: %v", res.start+uint32(len(res.blocks)), res.err)
+		}
+	}
+
+	return nil
+}
+
+// findForkPoint walks back from the last scanned height and returns the highest height
+// whose recorded hash still matches the node's chain.
+func (observer *BtcObserver) findForkPoint(scanned uint32) (uint32, error) {
+	cp := btcCheckPoints[observer.NetParam.Name].Height
+	for h := scanned; h > cp; h-- {
+		stored := observer.retryDB.GetBtcBlockHash(h)
+		if stored == "" {
+			return h, nil
+		}
+		hash, err := observer.cli.GetBlockHash(h)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get hash at height %d: %v", h, err)
+		}
+		if hash == stored {
+			return h, nil
+		}
+		log.Warnf("[BtcObserver] block %s at height %d is orphaned, now is %s", stored, h, hash)
+	}
+
+	return cp, nil
+}
+
+func (observer *BtcObserver) rollback(fork, top uint32) (uint32, error) {
+	newTop := fork + observer.conf.BtcObConfirmations - 1
+	orphaned, err := observer.retryDB.RollbackBtcBlocks(fork, newTop)
+	if err != nil {
+		return top, err
+	}
+	for _, o := range orphaned {
+		log.Errorf("[BtcObserver] deposit %s was relayed from orphaned block %s at height %d, need to follow up",
+			o.Txid, o.BlockHash, o.Height)
+	}
+	log.Warnf("[BtcObserver] reorg detected, rollback from %d to fork point %d, %d relayed deposits orphaned",
+		top-observer.conf.BtcObConfirmations+1, fork, len(orphaned))
+
+	return newTop, nil
+}
+
+// commitBlock puts the deposits of the block at height into the relay queue together with the
+// cursor, and then sends them to the relayer.
+func (observer *BtcObserver) commitBlock(height uint32, hash string, items []*CrossChainItem,
+	relaying chan *CrossChainItem) error {
+	deposits := make([]*db.QueuedDeposit, len(items))
+	for i, item := range items {
+		deposits[i] = &db.QueuedDeposit{
+			Txid:   item.Txid.String(),
+			Tx:     item.Tx,
+			Proof:  item.Proof,
+			Height: item.Height,
+		}
+	}
+	keys, err := observer.retryDB.CommitBtcBlock(height, hash, height+observer.conf.BtcObConfirmations-1, deposits)
+	if err != nil {
+		return err
+	}
+	for i, item := range items {
+		if err := observer.retryDB.ConfirmPendingDeposit(item.Txid.String(), height); err != nil {
+			log.Errorf("[BtcObserver] failed to confirm pending deposit %s: %v", item.Txid.String(), err)
+		}
+		item.Key = keys[i]
+		relaying <- item
+		log.Infof("[BtcObserver] eligible transaction found, txid: %s, %s", item.Txid.String(), item.Payload)
+	}
+	return nil
+}
+
+// queuedItem restores the item of a deposit in the relay queue.
+func queuedItem(d *db.QueuedDeposit) (*CrossChainItem, error) {
+	txid, err := chainhash.NewHashFromStr(d.Txid)
+	if err != nil {
+		return nil, err
+	}
+	mtx := wire.NewMsgTx(wire.TxVersion)
+	if err = mtx.BtcDecode(bytes.NewBuffer(d.Tx), wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+		return nil, fmt.Errorf("failed to decode tx: %v", err)
+	}
+	if len(mtx.TxOut) < 2 {
+		return nil, fmt.Errorf("tx has %d outputs", len(mtx.TxOut))
+	}
+	payload, err := ParseDepositPayload(mtx.TxOut[1].PkScript)
+	if err != nil {
+		return nil, err
 	}
+	return &CrossChainItem{
+		Tx:      d.Tx,
+		Proof:   d.Proof,
+		Height:  d.Height,
+		Txid:    *txid,
+		Payload: payload,
+		Key:     d.Key,
+	}, nil
 }
 
-func (observer *BtcObserver) SearchTxInBlock(txns []*wire.MsgTx, height uint32, relaying chan *CrossChainItem) int {
-	count := 0
-	for i := 0; i < len(txns); i++ {
-		if !checkIfCrossChainTx(txns[i], observer.NetParam) {
+// SearchTxInBlock relays the deposits in a block only when all of them are ready, so a block
+// failed here can be searched again without relaying any deposit twice.
+func (observer *BtcObserver) SearchTxInBlock(block *wire.MsgBlock, height uint32, relaying chan *CrossChainItem) (int, error) {
+	items, err := observer.findDeposits(block, height)
+	if err != nil {
+		return 0, err
+	}
+	for _, item := range items {
+		if err := observer.retryDB.PutBtcDeposit(height, item.Txid.String()); err != nil {
+			log.Errorf("[SearchTxInBlock] failed to record deposit %s: %v", item.Txid.String(), err)
+		}
+		if err := observer.retryDB.ConfirmPendingDeposit(item.Txid.String(), height); err != nil {
+			log.Errorf("[SearchTxInBlock] failed to confirm pending deposit %s: %v", item.Txid.String(), err)
+		}
+		relaying <- item
+		log.Infof("[SearchTxInBlock] eligible transaction found, txid: %s, %s", item.Txid.String(), item.Payload)
+	}
+
+	return len(items), nil
+}
+
+// findDeposits returns the deposits in a block worth relaying and records the rejected ones,
+// together with the federation outputs in the block.
+func (observer *BtcObserver) findDeposits(block *wire.MsgBlock, height uint32) ([]*CrossChainItem, error) {
+	if err := observer.recordUtxos(block, height); err != nil {
+		return nil, fmt.Errorf("failed to record federation outputs: %v", err)
+	}
+	items := make([]*CrossChainItem, 0)
+	for _, tx := range block.Transactions {
+		if !checkIfCrossChainTx(tx, observer.fed, height) {
 			continue
 		}
-		var buf bytes.Buffer
-		err := txns[i].BtcEncode(&buf, wire.ProtocolVersion, wire.LatestEncoding)
+		txid := tx.TxHash()
+		payload, err := ParseDepositPayload(tx.TxOut[1].PkScript)
 		if err != nil {
-			log.Errorf("[SearchTxInBlock] failed to encode transaction: %v", err)
+			observer.reject(txid.String(), height, fmt.Sprintf("invalid payload: %v", err))
 			continue
 		}
-		txid := txns[i].TxHash()
-		proof, err := observer.cli.GetProof([]string{txid.String()})
+		if err = observer.conf.DepositPolicy.Check(tx.TxOut[0].Value, payload); err != nil {
+			observer.reject(txid.String(), height, err.Error())
+			continue
+		}
+		raw, err := serializeTxNoWitness(tx)
 		if err != nil {
-			switch err.(type) {
-			case NetErr:
-				log.Errorf("[SearchTxInBlock] post err when try to get proof for tx %s: %v", txid.String(), err)
-				i--
-				<-time.Tick(time.Second * SleepTime)
-			default:
-				log.Errorf("[SearchTxInBlock] failed to get proof for tx %s: %v", txid.String(), err)
-			}
+			log.Errorf("[SearchTxInBlock] failed to encode transaction: %v", err)
 			continue
 		}
-		proofBytes, _ := hex.DecodeString(proof)
-		relaying <- &CrossChainItem{
-			Proof:  proofBytes,
-			Tx:     buf.Bytes(),
-			Height: height,
-			Txid:   txid,
+		proof, err := BuildMerkleProof(block, []chainhash.Hash{txid})
+		if err != nil {
+			return nil, fmt.Errorf("failed to build proof for tx %s: %v", txid.String(), err)
+		}
+		items = append(items, &CrossChainItem{
+			Proof:   proof,
+			Tx:      raw,
+			Height:  height,
+			Txid:    txid,
+			Payload: payload,
+		})
+	}
+
+	return items, nil
+}
+
+// recordUtxos records every output in block paying to the federation, deposits or the change of
+// withdrawals, for the withdrawals spending them to be checked.
+func (observer *BtcObserver) recordUtxos(block *wire.MsgBlock, height uint32) error {
+	utxos := make([]*db.FederationUtxo, 0)
+	for _, tx := range block.Transactions {
+		txid := tx.TxHash().String()
+		for i, out := range tx.TxOut {
+			if observer.fed.owner(out.PkScript) == nil {
+				continue
+			}
+			utxos = append(utxos, &db.FederationUtxo{
+				Txid:     txid,
+				Index:    uint32(i),
+				PkScript: out.PkScript,
+				Value:    out.Value,
+				Height:   height,
+			})
 		}
-		log.Infof("[SearchTxInBlock] eligible transaction found, txid: %s", txid.String())
-		count++
 	}
+	if len(utxos) == 0 {
+		return nil
+	}
+	return observer.retryDB.PutFederationUtxos(utxos)
+}
 
-	return count
+func (observer *BtcObserver) reject(txid string, height uint32, reason string) {
+	log.Errorf("[SearchTxInBlock] reject deposit %s at height %d: %s", txid, height, reason)
+	err := observer.retryDB.PutRejectedDeposit(&db.RejectedDeposit{
+		Txid:       txid,
+		Height:     height,
+		Reason:     reason,
+		RejectedAt: time.Now().Unix(),
+	})
+	if err != nil {
+		log.Errorf("[SearchTxInBlock] failed to record rejected deposit %s: %v", txid, err)
+	}
 }
 
 type AllianceObConfig struct {
-	AlliaObLoopWaitTime    int64  `json:"allia_ob_loop_wait_time"`
-	WatchingKey            string `json:"watching_key"`
-	AllianceJsonRpcAddress string `json:"alliance_json_rpc_address"`
-	WalletFile             string `json:"wallet_file"`
-	WalletPwd              string `json:"wallet_pwd"`
-	NetType                string `json:"net_type"`
-	WaitingCycle           uint32 `json:"waiting_cycle"`
+	AlliaObLoopWaitTime    int64             `json:"allia_ob_loop_wait_time"`
+	WatchingKey            string            `json:"watching_key"`
+	WatchingKeys           map[string]string `json:"watching_keys"`
+	AllowedContracts       []string          `json:"allowed_contracts"`
+	AllianceJsonRpcAddress string            `json:"alliance_json_rpc_address"`
+	WalletFile             string            `json:"wallet_file"`
+	WalletPwd              string            `json:"wallet_pwd"`
+	NetType                string            `json:"net_type"`
+	WaitingCycle           uint32            `json:"waiting_cycle"`
+	AllianceWsAddress      string            `json:"alliance_ws_address"`
 }
 
+// maxTxNotFoundTries is how many times a block is searched for a withdrawal spending a tx the
+// btc node doesn't find, before the withdrawal is quarantined to let the next blocks through.
+const maxTxNotFoundTries = 10
+
 type AllianceObserver struct {
-	allia   *sdk.MultiChainSdk
-	conf    *AllianceObConfig
-	retryDB *db.RetryDB
+	allia     AllianceClient
+	conf      *AllianceObConfig
+	retryDB   *db.RetryDB
+	validator *WithdrawalValidator
+	handlers  map[string]notifyHandler
+	contracts map[string]bool
+	notFound  map[uint32]int
+	lock      sync.Mutex
 }
 
-func NewAllianceObserver(allia *sdk.MultiChainSdk, conf *AllianceObConfig, rdb *db.RetryDB) *AllianceObserver {
-	return &AllianceObserver{
-		allia: allia,
-		conf:  conf,
-		retryDB: rdb,
+// NewAllianceObserver only accepts notifies emitted by allowed_contracts, the cross chain
+// manager by default, whose first state is one of watching_keys. watching_key is kept as a
+// key for the withdrawal handler.
+func NewAllianceObserver(allia AllianceClient, conf *AllianceObConfig, rdb *db.RetryDB,
+	validator *WithdrawalValidator) (*AllianceObserver, error) {
+	keys := make(map[string]string)
+	if conf.WatchingKey != "" {
+		keys[conf.WatchingKey] = HANDLER_WITHDRAWAL
+	}
+	for k, v := range conf.WatchingKeys {
+		keys[k] = v
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no watching key configured")
+	}
+	handlers := make(map[string]notifyHandler, len(keys))
+	for k, name := range keys {
+		h, ok := notifyHandlers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown handler %s for watching key %s", name, k)
+		}
+		handlers[k] = h
 	}
+
+	allowed := conf.AllowedContracts
+	if len(allowed) == 0 {
+		allowed = []string{utils.CrossChainManagerContractAddress.ToHexString()}
+	}
+	contracts := make(map[string]bool, len(allowed))
+	for _, addr := range allowed {
+		addr = strings.ToLower(strings.TrimPrefix(addr, "0x"))
+		if _, err := hex.DecodeString(addr); err != nil || len(addr) != 40 {
+			return nil, fmt.Errorf("allowed contract %s is not a hex address", addr)
+		}
+		contracts[addr] = true
+	}
+
+	return &AllianceObserver{
+		allia:     allia,
+		conf:      conf,
+		retryDB:   rdb,
+		validator: validator,
+		handlers:  handlers,
+		contracts: contracts,
+		notFound:  make(map[uint32]int),
+	}, nil
 }
 
+// Listen captures withdrawals block by block. The withdrawals of a block are put into the
+// outbox together with the cursor, and stay there until the relayer is done with them, so
+// they're sent again after a restart. With alliance_ws_address set, blocks are pushed by a
+// websocket subscription, and polled while it's down.
 func (observer *AllianceObserver) Listen(collecting chan *FromAllianceItem) {
 	top := observer.retryDB.GetAlliaHeight()
 	if top < alliaCheckPoints[observer.conf.NetType].Height {
 		top = alliaCheckPoints[observer.conf.NetType].Height
 	}
 
+	pending, err := observer.retryDB.GetAlliaOutbox()
+	if err != nil {
+		log.Errorf("[AllianceObserver] failed to get withdrawals in outbox: %v", err)
+	}
+	if len(pending) > 0 {
+		log.Infof("[AllianceObserver] resume %d withdrawals from outbox", len(pending))
+	}
+	for _, o := range pending {
+		collecting <- &FromAllianceItem{
+			Tx:  o.Tx,
+			Key: o.Key,
+		}
+	}
+
 	log.Infof("[AllianceObserver] get start height %d from checkpoint, check once %d seconds", top, observer.conf.AlliaObLoopWaitTime)
+	if observer.conf.AllianceWsAddress == "" {
+		observer.poll(top, collecting, nil)
+		return
+	}
+	for {
+		top = observer.subscribe(top, collecting)
+		log.Warnf("[AllianceObserver] websocket subscription lost, fall back to polling for %d seconds", SleepTime)
+		top = observer.poll(top, collecting, time.After(time.Second*SleepTime))
+	}
+}
+
+// poll checks the alliance height once AlliaObLoopWaitTime seconds and captures the new blocks,
+// until stop fires. It returns the last committed height.
+func (observer *AllianceObserver) poll(top uint32, collecting chan *FromAllianceItem, stop <-chan time.Time) uint32 {
 	tick := time.NewTicker(time.Duration(observer.conf.AlliaObLoopWaitTime) * time.Second)
+	defer tick.Stop()
 	for {
 		select {
+		case <-stop:
+			return top
 		case <-tick.C:
-			count := 0
 			newTop, err := observer.allia.GetCurrentBlockHeight()
 			if err != nil {
 				log.Errorf("[AllianceObserver] failed to get current height, retry after 10 sec: %v", err)
@@ -181,50 +602,156 @@ func (observer *AllianceObserver) Listen(collecting chan *FromAllianceItem) {
 			}
 			log.Tracef("[AllianceObserver] start observing from height %d", newTop)
 
-			if newTop-top == 0 {
-				continue
-			}
-
-			h := top + 1
-			for h <= newTop {
-				events, err := observer.allia.GetSmartContractEventByBlock(h)
+			count := 0
+			for top < newTop {
+				items, err := observer.searchEventsInBlock(top + 1)
 				if err != nil {
 					log.Errorf("[AllianceObserver] GetSmartContractEventByBlock failed, retry after 10 sec: %v", err)
 					<-time.Tick(time.Second * SleepTime)
 					continue
 				}
-
-				for _, e := range events {
-					for _, n := range e.Notify {
-						states, ok := n.States.([]interface{})
-						if !ok {
-							continue
-						}
-						name, ok := states[0].(string)
-						if ok && name == observer.conf.WatchingKey {
-							tx := states[1].(string)
-							collecting <- &FromAllianceItem{
-								Tx: tx,
-							}
-							count++
-							log.Infof("[AllianceObserver] captured: %s when height is %d", tx, h)
-						}
-					}
+				if err = observer.commitBlock(top+1, items, collecting); err != nil {
+					log.Errorf("[AllianceObserver] failed to commit alliance height %d, retry after 10 sec: %v", top+1, err)
+					<-time.Tick(time.Second * SleepTime)
+					continue
 				}
-
-				h++
+				count += len(items)
+				top++
 			}
 			if count > 0 {
 				log.Infof("[AllianceObserver] total %d transactions captured this time", count)
 			}
-			top = newTop
-			if count > 0 || top%observer.conf.WaitingCycle == 0 {
-				err := observer.retryDB.SetBtcHeight(top)
-				log.Tracef("[AlliaObserver] write allia height %d", top)
-				if err != nil {
-					log.Errorf("[AllianceObserver] failed to set alliance height: %v", err)
+			log.Tracef("[AlliaObserver] write allia height %d", top)
+		}
+	}
+}
+
+// commitBlock puts the withdrawals of the block at height into the outbox together with the
+// cursor, and then sends them to the relayer.
+func (observer *AllianceObserver) commitBlock(height uint32, items []*FromAllianceItem,
+	collecting chan *FromAllianceItem) error {
+	txs := make([]string, len(items))
+	for i, item := range items {
+		txs[i] = item.Tx
+	}
+	keys, err := observer.retryDB.CommitAlliaBlock(height, txs)
+	if err != nil {
+		return err
+	}
+	for i, item := range items {
+		item.Key = keys[i]
+		collecting <- item
+		log.Infof("[AllianceObserver] captured: %s when height is %d", item.Tx, height)
+	}
+	return nil
+}
+
+// Rescan captures the withdrawals in alliance blocks [from, to] again without touching the
+// cursor.
+func (observer *AllianceObserver) Rescan(from, to uint32, collecting chan *FromAllianceItem) error {
+	if from > to {
+		return fmt.Errorf("wrong range from %d to %d", from, to)
+	}
+	for h := from; h <= to; h++ {
+		items, err := observer.searchEventsInBlock(h)
+		if err != nil {
+			return fmt.Errorf("failed to get events at height %d: %v", h, err)
+		}
+		for _, item := range items {
+			collecting <- item
+			log.Infof("[AllianceObserver] rescan: captured %s when height is %d", item.Tx, h)
+		}
+	}
+	return nil
+}
+
+// searchEventsInBlock returns the valid withdrawals in the block at height and quarantines
+// the malformed ones. It fails when the btc node is unreachable to check the withdrawals.
+func (observer *AllianceObserver) searchEventsInBlock(height uint32) ([]*FromAllianceItem, error) {
+	events, err := observer.allia.GetSmartContractEventByBlock(height)
+	if err != nil {
+		return nil, err
+	}
+	return observer.captureEvents(height, events)
+}
+
+// captureEvents returns the valid withdrawals in events of the block at height and quarantines
+// the malformed ones. A withdrawal spending a tx not found fails the block, until it's failed
+// maxTxNotFoundTries times and the withdrawal is quarantined.
+func (observer *AllianceObserver) captureEvents(height uint32, events []*sdkcom.SmartContactEvent) (
+	[]*FromAllianceItem, error) {
+	items := make([]*FromAllianceItem, 0)
+	index := uint32(0)
+	for _, e := range events {
+		for _, n := range e.Notify {
+			states, ok := n.States.([]interface{})
+			if !ok || len(states) == 0 {
+				continue
+			}
+			name, ok := states[0].(string)
+			if !ok {
+				continue
+			}
+			handler, ok := observer.handlers[name]
+			if !ok {
+				continue
+			}
+			if !observer.contracts[strings.ToLower(n.ContractAddress)] {
+				log.Warnf("[AllianceObserver] ignore notify %s at height %d from contract %s, which is not allowed",
+					name, height, n.ContractAddress)
+				continue
+			}
+			index++
+			item, err := handler(observer, height, index, states)
+			if err != nil {
+				switch err.(type) {
+				case NetErr:
+					return nil, err
+				case TxNotFoundErr:
+					if observer.countNotFound(height) < maxTxNotFoundTries {
+						return nil, err
+					}
+					err = fmt.Errorf("spent tx still not found after %d tries, check if the btc node "+
+						"runs with -txindex: %v", maxTxNotFoundTries, err)
 				}
+				observer.quarantine(height, index, states, err.Error())
+				continue
+			}
+			if item != nil {
+				items = append(items, item)
 			}
 		}
 	}
+	observer.lock.Lock()
+	delete(observer.notFound, height)
+	observer.lock.Unlock()
+	return items, nil
+}
+
+// countNotFound counts a try of the block at height failed for a spent tx not found, and returns
+// how many tries have failed so.
+func (observer *AllianceObserver) countNotFound(height uint32) int {
+	observer.lock.Lock()
+	defer observer.lock.Unlock()
+	observer.notFound[height]++
+	return observer.notFound[height]
+}
+
+func (observer *AllianceObserver) quarantine(height, index uint32, states []interface{}, reason string) {
+	log.Errorf("[AllianceObserver] quarantine withdrawal %d at height %d: %s", index, height, reason)
+	raw, err := json.Marshal(states)
+	if err != nil {
+		raw = []byte(fmt.Sprintf("%v", states))
+	}
+	err = observer.retryDB.PutQuarantinedWithdrawal(&db.QuarantinedWithdrawal{
+		Height:        height,
+		Index:         index,
+		States:        string(raw),
+		Reason:        reason,
+		QuarantinedAt: time.Now().Unix(),
+	})
+	if err != nil {
+		log.Errorf("[AllianceObserver] failed to record quarantined withdrawal %d at height %d: %v", index,
+			height, err)
+	}
 }
@@ -1,121 +1,1497 @@
-package observer
+package observer_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/btcjson"
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/go-zeromq/zmq4"
+	"github.com/gorilla/websocket"
+	"github.com/ontio/btcrelayer/db"
+	"github.com/ontio/btcrelayer/internal/testutil"
+	"github.com/ontio/btcrelayer/observer"
+	"github.com/ontio/multi-chain/native/service/cross_chain_manager/btc"
+	"github.com/ontio/multi-chain/native/service/utils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 const (
-	ADDR = "http://172.168.3.77:18443" //"http://139.219.140.220:20332"
-	USER = "test"
-	PWD  = "test"
+	txArrHex = "01000000019f074c07f34ffdcac88f76aa403e0725a90870b974c777a7236d6db067481ff2020000006b483045022100c5647452812dd245de91536de723d35239cbd49bb4dd924a5b6376b099a8a716022078938060af6771a44913893eaf0b091de365ee3a7a6ecefa830bf5d4caf6c996012103128a2c4525179e47f38cf3fefca37a61548ca4610255b3fb4ee86de2d3e80c0fffffffff03204e00000000000017a91487a9652e9b396545598c0fc72cb5a98848bf93d3870000000000000000276a256600000000000000020000000000000000f3b8a17f1f957f60c88f105e32ebff3f022e56a4a8ae0800000000001976a91428d2e8cee08857f569e5a1b147c5d5e87339e08188ac00000000"
+	USER     = "test"
+	PWD      = "test"
 )
 
+// newBitcoindStandIn serves the JSON-RPC calls of RestCli from chain. Without txindex,
+// getrawtransaction only finds txs in the mempool like bitcoind.
+func newBitcoindStandIn(t *testing.T, chain *testutil.FakeBtcChain, txindex bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &observer.Request{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			t.Error(err)
+			return
+		}
+		resp := &observer.Response{Id: req.Id}
+		fail := func(code btcjson.RPCErrorCode, err error) {
+			resp.Error = &btcjson.RPCError{Code: code, Message: err.Error()}
+		}
+		switch req.Method {
+		case "getchaintips":
+			height, hash, _ := chain.GetCurrentHeightAndHash()
+			resp.Result = []map[string]interface{}{{"height": height, "hash": hash, "branchlen": 0, "status": "active"}}
+		case "getblockhash":
+			hash, err := chain.GetBlockHash(uint32(req.Params[0].(float64)))
+			if err != nil {
+				fail(btcjson.ErrRPCInvalidParameter, err)
+			}
+			resp.Result = hash
+		case "getblock":
+			fail(btcjson.ErrRPCBlockNotFound, errors.New("Block not found"))
+			for h := uint32(0); h <= chain.Height(); h++ {
+				block, hash, _ := chain.GetBlockByHeight(h)
+				if hash == req.Params[0].(string) {
+					var buf bytes.Buffer
+					block.BtcEncode(&buf, wire.ProtocolVersion, wire.LatestEncoding)
+					resp.Result, resp.Error = hex.EncodeToString(buf.Bytes()), nil
+				}
+			}
+		case "gettxoutproof":
+			txids := make([]string, 0)
+			for _, txid := range req.Params[0].([]interface{}) {
+				txids = append(txids, txid.(string))
+			}
+			proof, err := chain.GetProof(txids)
+			if err != nil {
+				fail(btcjson.ErrRPCInvalidAddressOrKey, err)
+			}
+			resp.Result = proof
+		case "getrawtransaction":
+			mtx, err := chain.GetRawTransaction(req.Params[0].(string))
+			if err != nil {
+				fail(btcjson.ErrRPCInvalidAddressOrKey, err)
+				break
+			}
+			confs, _ := chain.GetTxConfirmations(mtx.TxHash().String())
+			if confs > 0 && !txindex {
+				fail(btcjson.ErrRPCInvalidAddressOrKey, errors.New("No such mempool transaction. "+
+					"Use -txindex or provide a block hash to enable blockchain transaction queries"))
+				break
+			}
+			if !req.Params[1].(bool) {
+				var buf bytes.Buffer
+				mtx.BtcEncode(&buf, wire.ProtocolVersion, wire.LatestEncoding)
+				resp.Result = hex.EncodeToString(buf.Bytes())
+				break
+			}
+			vout := make([]map[string]interface{}, 0)
+			for _, out := range mtx.TxOut {
+				vout = append(vout, map[string]interface{}{
+					"value":        out.Value,
+					"scriptPubKey": map[string]string{"hex": hex.EncodeToString(out.PkScript)},
+				})
+			}
+			resp.Result = map[string]interface{}{"confirmations": confs, "vout": vout}
+		case "sendrawtransaction":
+			txid, err := chain.BroadcastTx(req.Params[0].(string))
+			if err != nil {
+				fail(btcjson.ErrRPCTxRejected, err)
+			}
+			resp.Result = txid
+		default:
+			fail(btcjson.ErrRPCMethodNotFound.Code, fmt.Errorf("Method not found: %s", req.Method))
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
 func TestRestCli_GetProof(t *testing.T) {
-	cli := NewRestCli(ADDR, USER, PWD)
-	//p := make([][]string, 0)
-	//p = append(p, []string{"aa03857ff7b13d565b79d3724e516822cca223eb5dd83dd7cb35094bb7070032"})
-	proof, err := cli.GetProof([]string{"aa03857ff7b13d565b79d3724e516822cca223eb5dd83dd7cb35094bb7070032"})
+	chain := testutil.NewFakeBtcChain(&chaincfg.RegressionNetParams)
+	txid := chain.InjectDeposit(10000)
+	chain.Mine(1)
+	srv := newBitcoindStandIn(t, chain, true)
+	defer srv.Close()
+
+	cli := observer.NewRestCli(srv.URL, USER, PWD)
+	proof, err := cli.GetProof([]string{txid.String()})
 	if err != nil {
 		t.Fatalf("Failed to get proof: %v", err)
 	}
-
-	fmt.Printf("Proof is %s\n", proof)
+	if want, _ := chain.GetProof([]string{txid.String()}); proof != want {
+		t.Fatalf("wrong proof %s", proof)
+	}
+	if _, err = cli.GetProof([]string{chain.NewDepositTx(10000).TxHash().String()}); err == nil {
+		t.Fatal("should fail for a tx not in a block")
+	}
 }
 
 func TestRestCli_GetCurrentHeight(t *testing.T) {
-	cli := NewRestCli(ADDR, USER, PWD)
-	h, hash, err := cli.GetCurrentHeightAndHash()
+	chain := testutil.NewFakeBtcChain(&chaincfg.RegressionNetParams)
+	chain.Mine(3)
+	srv := newBitcoindStandIn(t, chain, true)
+	defer srv.Close()
+
+	h, hash, err := observer.NewRestCli(srv.URL, USER, PWD).GetCurrentHeightAndHash()
 	if err != nil {
 		t.Fatalf("Failed to get height: %v", err)
 	}
-
-	fmt.Printf("height is %d and hash is %s\n", h, hash)
+	if want, _ := chain.GetBlockHash(3); h != 3 || hash != want {
+		t.Fatalf("wrong tip: %d, %s", h, hash)
+	}
 }
 
 func TestRestCli_GetTxsInBlock(t *testing.T) {
-	cli := NewRestCli(ADDR, USER, PWD)
-	txns, hash, err := cli.GetTxsInBlock("000000000000024a13137f661835a5f1fbc52b1b21e031f82637ad4301cebafa")
+	chain := testutil.NewFakeBtcChain(&chaincfg.RegressionNetParams)
+	chain.Mine(1)
+	txid := chain.InjectDeposit(10000)
+	chain.Mine(1)
+	srv := newBitcoindStandIn(t, chain, true)
+	defer srv.Close()
+
+	cli := observer.NewRestCli(srv.URL, USER, PWD)
+	hash, _ := chain.GetBlockHash(2)
+	txns, prev, err := cli.GetTxsInBlock(hash)
 	if err != nil {
 		t.Fatalf("Failed to get txns: %v", err)
 	}
+	if want, _ := chain.GetBlockHash(1); prev != want {
+		t.Fatalf("wrong previous block %s", prev)
+	}
+	if len(txns) != 2 || txns[1].TxHash() != txid {
+		t.Fatal("wrong txns in block")
+	}
+	if _, _, err = cli.GetTxsInBlock(strings.Repeat("00", 32)); err == nil {
+		t.Fatal("err should not be nil")
+	}
+}
 
-	fmt.Printf("Successful to get tx from block %s\n", hash)
-	for i, tx := range txns {
-		fmt.Printf("No%d, prevOP: %x\n", i, tx.TxIn[0].PreviousOutPoint.Hash[:])
+func newTestBtcObserver(t *testing.T) (*observer.BtcObserver, *testutil.FakeBtcChain, func()) {
+	dir, err := ioutil.TempDir("", "btc_ob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := db.NewRetryDB(dir, 0, 1, 5000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	observer.SleepTime = 1
+	chain := testutil.NewFakeBtcChain(&chaincfg.RegressionNetParams)
+	o, err := observer.NewBtcObserver(&observer.BtcObConfig{
+		NetType:            "regtest",
+		BtcObLoopWaitTime:  1,
+		BtcObConfirmations: 1,
+		WaitingCycle:       1,
+	}, chain, rdb)
+	if err != nil {
+		t.Fatal(err)
 	}
+	return o, chain, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func waitItem(t *testing.T, line chan *observer.CrossChainItem) *observer.CrossChainItem {
+	select {
+	case item := <-line:
+		return item
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for cross chain item")
+	}
+	return nil
 }
 
 func TestBtcObserver_SearchTxInBlock(t *testing.T) {
-	line := make(chan *CrossChainItem, 2)
-	o := NewBtcObserver(ADDR, USER, PWD, &chaincfg.TestNet3Params, &BtcObConfig{
-		FirstN:        100,
-		LoopWaitTime:  10,
-		Confirmations: 6,
-	})
-	txns, _, err := o.cli.GetTxsInBlock("00000000000000e8480643ba362b80f449a94743b65cefc03a460bf42167d3fc")
+	o, chain, clean := newTestBtcObserver(t)
+	defer clean()
+	line := make(chan *observer.CrossChainItem, 2)
+	txid := chain.InjectDeposit(10000)
+	chain.InjectTx(wire.NewMsgTx(wire.TxVersion))
+	chain.Mine(1)
+
+	block, _, err := chain.GetBlockByHeight(1)
 	if err != nil {
-		t.Fatalf("Failed to get txns: %v", err)
+		t.Fatalf("Failed to get block: %v", err)
 	}
-
-	count, err := o.SearchTxInBlock(txns, 1574156, line)
+	count, err := o.SearchTxInBlock(block, 1, line)
 	if err != nil {
 		t.Fatalf("Failed to search: %v", err)
 	}
+	if count != 1 {
+		t.Fatalf("count should be 1, not %d", count)
+	}
 
-	fmt.Printf("Total count : %d\n", count)
+	item := <-line
+	if item.Txid != txid || item.Height != 1 || len(item.Proof) == 0 {
+		t.Fatalf("wrong item: %s at %d", item.Txid.String(), item.Height)
+	}
+}
 
-	item, ok := <-line
-	if ok {
-		fmt.Printf("Item txid: %s\n", item.Txid)
-		fmt.Printf("Item heigh: %d\n", item.Height)
-		fmt.Printf("Item proof: %s\n", item.Proof)
-		fmt.Printf("Item tx: %s\n", item.Tx)
+func TestCheckIfCrossChainTx_Rotation(t *testing.T) {
+	chain := testutil.NewFakeBtcChain(&chaincfg.RegressionNetParams)
+	oldRedeem, _ := hex.DecodeString(observer.REDEEM_SCRIPT_HEX)
+	newRedeem := []byte{txscript.OP_2, txscript.OP_2, txscript.OP_EQUAL}
+	fed, err := observer.NewFederation([]*observer.FederationScript{
+		{
+			RedeemScript: observer.REDEEM_SCRIPT_HEX,
+			RetireHeight: 20,
+		},
+		{
+			RedeemScript:     hex.EncodeToString(newRedeem),
+			ActivationHeight: 15,
+		},
+	}, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toOld := chain.NewDepositTxTo(oldRedeem, 10000)
+	toNew := chain.NewDepositTxTo(newRedeem, 10000)
+	for _, c := range []struct {
+		height uint32
+		old    bool
+		new    bool
+	}{
+		{10, true, false},
+		{15, true, true},
+		{19, true, true},
+		{20, false, true},
+	} {
+		if observer.CheckIfCrossChainTx(toOld, fed, c.height) != c.old || observer.CheckIfCrossChainTx(toNew, fed, c.height) != c.new {
+			t.Fatalf("wrong result at height %d", c.height)
+		}
+	}
+
+	_, err = observer.NewFederation([]*observer.FederationScript{
+		{
+			RedeemScript:     observer.REDEEM_SCRIPT_HEX,
+			ActivationHeight: 20,
+			RetireHeight:     20,
+		},
+	}, &chaincfg.RegressionNetParams)
+	if err == nil {
+		t.Fatal("err should not be nil")
+	}
+}
+
+func TestBtcObserver_SearchTxInBlockSegwit(t *testing.T) {
+	o, chain, clean := newTestBtcObserver(t)
+	defer clean()
+	line := make(chan *observer.CrossChainItem, 10)
+	redeem, _ := hex.DecodeString(observer.REDEEM_SCRIPT_HEX)
+	pkScripts, err := observer.FederationPkScripts(redeem, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txscript.GetScriptClass(pkScripts[1]) != txscript.WitnessV0ScriptHashTy ||
+		txscript.GetScriptClass(pkScripts[2]) != txscript.ScriptHashTy {
+		t.Fatal("wrong script class")
+	}
+	txids := make(map[chainhash.Hash]bool)
+	for _, pkScript := range pkScripts {
+		tx := chain.NewDepositTxToScript(pkScript, 10000)
+		tx.TxIn[0].Witness = wire.TxWitness{[]byte{0x01, 0x02}, redeem}
+		txids[chain.InjectTx(tx)] = true
+	}
+	chain.Mine(1)
+
+	block, _, _ := chain.GetBlockByHeight(1)
+	count, err := o.SearchTxInBlock(block, 1, line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("count should be 3, not %d", count)
+	}
+	for i := 0; i < 3; i++ {
+		item := <-line
+		mtx := wire.NewMsgTx(wire.TxVersion)
+		if err = mtx.Deserialize(bytes.NewBuffer(item.Tx)); err != nil {
+			t.Fatal(err)
+		}
+		if mtx.HasWitness() || !txids[mtx.TxHash()] || mtx.TxHash() != item.Txid {
+			t.Fatalf("relayed tx %s should be stripped of witness", item.Txid.String())
+		}
+	}
+}
+
+func TestParseDepositPayload(t *testing.T) {
+	addr := bytes.Repeat([]byte{0xab}, 20)
+	build := func(flag byte, chainId, fee uint64, addr []byte) []byte {
+		data := make([]byte, 17)
+		data[0] = flag
+		binary.BigEndian.PutUint64(data[1:9], chainId)
+		binary.BigEndian.PutUint64(data[9:17], fee)
+		script, _ := txscript.NullDataScript(append(data, addr...))
+		return script
+	}
+
+	p, err := observer.ParseDepositPayload(build(btc.OP_RETURN_SCRIPT_FLAG, 2, 1000, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ToChainId != 2 || p.Fee != 1000 || !bytes.Equal(p.ToAddress, addr) {
+		t.Fatalf("wrong payload: %s", p)
+	}
+
+	for i, script := range [][]byte{
+		{txscript.OP_RETURN},
+		{txscript.OP_RETURN, 0x25},
+		{txscript.OP_DUP, txscript.OP_HASH160},
+		build(0x65, 2, 1000, addr),
+		build(btc.OP_RETURN_SCRIPT_FLAG, 2, 1000, nil),
+		build(btc.OP_RETURN_SCRIPT_FLAG, 2, 1<<63, addr),
+		build(btc.OP_RETURN_SCRIPT_FLAG, observer.BTC_ID, 1000, addr),
+	} {
+		if _, err = observer.ParseDepositPayload(script); err == nil {
+			t.Fatalf("no%d: err should not be nil", i)
+		}
+	}
+
+	o, chain, clean := newTestBtcObserver(t)
+	defer clean()
+	line := make(chan *observer.CrossChainItem, 10)
+	tx := chain.NewDepositTx(10000)
+	tx.TxOut[1].PkScript = []byte{txscript.OP_RETURN, txscript.OP_DATA_1, 0x66}
+	chain.InjectTx(tx)
+	txid := chain.InjectDeposit(10000)
+	chain.Mine(1)
+	block, _, _ := chain.GetBlockByHeight(1)
+	count, err := o.SearchTxInBlock(block, 1, line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("count should be 1, not %d", count)
+	}
+	item := <-line
+	if item.Txid != txid || item.Payload == nil || item.Payload.ToChainId != 2 {
+		t.Fatal("wrong item")
+	}
+}
+
+func TestDepositPolicy_Check(t *testing.T) {
+	policy := &observer.DepositPolicy{
+		MinAmount:       1000,
+		MaxAmount:       100000,
+		AllowedChainIds: []uint64{2, 3},
+		AllianceGasCost: 100,
+	}
+	for i, c := range []struct {
+		value   int64
+		payload *observer.DepositPayload
+		ok      bool
+	}{
+		{10000, &observer.DepositPayload{ToChainId: 2, Fee: 100}, true},
+		{999, &observer.DepositPayload{ToChainId: 2, Fee: 100}, false},
+		{100001, &observer.DepositPayload{ToChainId: 3, Fee: 100}, false},
+		{10000, &observer.DepositPayload{ToChainId: 4, Fee: 100}, false},
+		{10000, &observer.DepositPayload{ToChainId: 2, Fee: 99}, false},
+		{1000, &observer.DepositPayload{ToChainId: 2, Fee: 1000}, false},
+	} {
+		if err := policy.Check(c.value, c.payload); (err == nil) != c.ok {
+			t.Fatalf("no%d: wrong result: %v", i, err)
+		}
+	}
+	var none *observer.DepositPolicy
+	if err := none.Check(10000, &observer.DepositPayload{ToChainId: 4}); err != nil {
+		t.Fatalf("nil policy should pass: %v", err)
+	}
+	if err := none.Check(1000, &observer.DepositPayload{Fee: 1000}); err == nil {
+		t.Fatal("nil policy should still refuse fee not less than amount")
+	}
+
+	o, chain, clean := newTestBtcObserver(t)
+	defer clean()
+	o.Conf().DepositPolicy = policy
+	line := make(chan *observer.CrossChainItem, 10)
+	small := chain.InjectDeposit(100)
+	chain.Mine(1)
+	block, _, _ := chain.GetBlockByHeight(1)
+	count, err := o.SearchTxInBlock(block, 1, line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatal("deposit should be rejected")
+	}
+	rejected, err := o.RetryDB().GetRejectedDeposits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 1 || rejected[0].Txid != small.String() || rejected[0].Height != 1 || rejected[0].Reason == "" {
+		t.Fatal("rejected deposit should be recorded")
 	}
 }
 
 func TestBtcObserver_Listen(t *testing.T) {
-	line := make(chan *CrossChainItem, 10)
-	o := NewBtcObserver(ADDR, USER, PWD, &chaincfg.TestNet3Params, &BtcObConfig{
-		FirstN:        100,
-		LoopWaitTime:  10,
-		Confirmations: 6,
-	})
+	o, chain, clean := newTestBtcObserver(t)
+	defer clean()
+	line := make(chan *observer.CrossChainItem, 10)
+	chain.Mine(5)
+	go o.Listen(line)
+
+	txid := chain.InjectDeposit(10000)
+	chain.Mine(1)
+	item := waitItem(t, line)
+	if item.Txid != txid || item.Height != 6 {
+		t.Fatalf("wrong item: %s at %d", item.Txid.String(), item.Height)
+	}
+
+	chain.Fail("GetBlockByHeight", 2, observer.NetErr{errors.New("connection refused")})
+	txid = chain.InjectDeposit(20000)
+	chain.Mine(1)
+	item = waitItem(t, line)
+	if item.Txid != txid || item.Height != 7 {
+		t.Fatalf("wrong item: %s at %d", item.Txid.String(), item.Height)
+	}
+}
+
+func TestBtcObserver_ListenPauseWhenSyncing(t *testing.T) {
+	o, chain, clean := newTestBtcObserver(t)
+	defer clean()
+	line := make(chan *observer.CrossChainItem, 10)
+	chain.Mine(5)
+	chain.SetSyncing(100, true)
+	go o.Listen(line)
+
+	chain.InjectDeposit(10000)
+	chain.Mine(1)
+	select {
+	case item := <-line:
+		t.Fatalf("should not relay from a syncing node: %s", item.Txid.String())
+	case <-time.After(3 * time.Second):
+	}
+	if !strings.HasPrefix(o.Status(), "syncing") {
+		t.Fatalf("wrong status: %s", o.Status())
+	}
+
+	chain.SetSyncing(0, false)
+	if item := waitItem(t, line); item.Height != 6 {
+		t.Fatalf("wrong item height %d", item.Height)
+	}
+	if !strings.HasPrefix(o.Status(), "synced") {
+		t.Fatalf("wrong status: %s", o.Status())
+	}
+
+	// a header ahead of the blocks is routine at the tip
+	chain.SetSyncing(chain.Height()+2, false)
+	chain.InjectDeposit(10000)
+	chain.Mine(1)
+	if item := waitItem(t, line); item.Height != 7 {
+		t.Fatalf("wrong item height %d", item.Height)
+	}
+}
+
+func TestRestCli_GetCurrentHeightAndHash(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"result":[` +
+			`{"height":120,"hash":"aa","branchlen":2,"status":"headers-only"},` +
+			`{"height":118,"hash":"bb","branchlen":0,"status":"active"},` +
+			`{"height":117,"hash":"cc","branchlen":1,"status":"valid-fork"}],"error":null,"id":1}`))
+	}))
+	defer srv.Close()
+
+	height, hash, err := observer.NewRestCli(srv.URL, USER, PWD).GetCurrentHeightAndHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 118 || hash != "bb" {
+		t.Fatalf("should pick the active tip, got %d %s", height, hash)
+	}
+}
+
+func TestBtcObserver_ListenInvalidHeader(t *testing.T) {
+	o, chain, clean := newTestBtcObserver(t)
+	defer clean()
+	line := make(chan *observer.CrossChainItem, 10)
+	chain.Mine(5)
 	go o.Listen(line)
+
+	chain.InjectDeposit(10000)
+	chain.MineInvalid()
+	chain.Mine(1)
+	select {
+	case item := <-line:
+		t.Fatalf("should not relay from an invalid block: %s", item.Txid.String())
+	case <-time.After(3 * time.Second):
+	}
+	if top := o.RetryDB().GetBtcHeight(); top > 5 {
+		t.Fatalf("should not scan past the invalid block, now at %d", top)
+	}
+}
+
+func TestBtcObserver_ListenPastCheckpoint(t *testing.T) {
+	o, chain, clean := newTestBtcObserver(t)
+	defer clean()
+	line := make(chan *observer.CrossChainItem, 10)
+	chain.Mine(20)
+	// a cursor left by a version without the header chain
+	if err := o.RetryDB().SetBtcHeight(18); err != nil {
+		t.Fatal(err)
+	}
+	go o.Listen(line)
+
+	txid := chain.InjectDeposit(10000)
+	chain.Mine(1)
+	if item := waitItem(t, line); item.Txid != txid {
+		t.Fatalf("should relay %s, not %s", txid.String(), item.Txid.String())
+	}
+	for h := uint32(0); h <= 21; h++ {
+		if o.Header(h) == nil {
+			t.Fatalf("header at height %d should be backfilled", h)
+		}
+	}
+}
+
+func TestBtcObserver_ListenInOrder(t *testing.T) {
+	o, chain, clean := newTestBtcObserver(t)
+	defer clean()
+	o.SetCli(chain, 4, 2)
+	line := make(chan *observer.CrossChainItem, 100)
+	chain.Mine(5)
+	txids := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		txids = append(txids, chain.InjectDeposit(int64(10000+i)).String())
+		chain.Mine(1)
+	}
+	chain.Fail("GetBlockByHeight", 3, observer.NetErr{errors.New("connection refused")})
+	go o.Listen(line)
+
+	for i, txid := range txids {
+		item := waitItem(t, line)
+		if item.Txid.String() != txid || item.Height != uint32(6+i) {
+			t.Fatalf("no%d: wrong item %s at %d", i, item.Txid.String(), item.Height)
+		}
+	}
+	select {
+	case item := <-line:
+		t.Fatalf("deposit %s relayed twice", item.Txid.String())
+	case <-time.After(2 * time.Second):
+	}
+	if h := o.RetryDB().GetBtcHeight(); h != 25 {
+		t.Fatalf("btc height should be 25, not %d", h)
+	}
+}
+
+func TestBtcObserver_ListenWithZmq(t *testing.T) {
+	pub := zmq4.NewPub(context.Background())
+	defer pub.Close()
+	if err := pub.Listen("tcp://127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	o, chain, clean := newTestBtcObserver(t)
+	defer clean()
+	o.Conf().BtcObLoopWaitTime = 3600
+	zmq := observer.NewZmqSubscriber("tcp://"+pub.Addr().String(), observer.ZMQ_HASHBLOCK)
+	defer zmq.Stop()
+	o.SetZmq(zmq)
+	line := make(chan *observer.CrossChainItem, 10)
+	chain.Mine(5)
+	go o.Listen(line)
+
+	txid := chain.InjectDeposit(10000)
+	chain.Mine(1)
+	hash, _ := chain.GetBlockHash(6)
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
-		for item := range line {
-			fmt.Printf("Item heigh: %d\t", item.Height)
-			fmt.Printf("Item proof: %s\t", item.Proof)
-			fmt.Printf("Item txid: %s\n", item.Txid)
+		for {
+			pub.Send(zmq4.NewMsgFrom([]byte(observer.ZMQ_HASHBLOCK), []byte(hash), []byte{0, 0, 0, 0}))
+			select {
+			case <-done:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
 		}
 	}()
-	time.Sleep(time.Second * 30)
+
+	item := waitItem(t, line)
+	if item.Txid != txid || item.Height != 6 {
+		t.Fatalf("wrong item: %s at %d", item.Txid.String(), item.Height)
+	}
 }
 
-func TestRestCli_GetScriptPubKey(t *testing.T) {
-	cli := NewRestCli(ADDR, USER, PWD)
-	s, err := cli.GetScriptPubKey("8aa56bcc191e51b3214343f31b09c228626a3891f6791ff198195da76088f29b", 0)
+func TestBtcObserver_ListenReorg(t *testing.T) {
+	o, chain, clean := newTestBtcObserver(t)
+	defer clean()
+	line := make(chan *observer.CrossChainItem, 10)
+	chain.Mine(5)
+	go o.Listen(line)
+
+	orphan := chain.InjectDeposit(10000)
+	chain.Mine(1)
+	if item := waitItem(t, line); item.Txid != orphan {
+		t.Fatalf("wrong item: %s", item.Txid.String())
+	}
+
+	txid := chain.InjectDeposit(20000)
+	chain.Reorg(1, 2)
+	item := waitItem(t, line)
+	if item.Txid != txid || item.Height != 6 {
+		t.Fatalf("wrong item: %s at %d", item.Txid.String(), item.Height)
+	}
+	hash, _ := chain.GetBlockHash(6)
+	if o.RetryDB().GetBtcBlockHash(6) != hash {
+		t.Fatal("block hash at 6 should be replaced")
+	}
+
+	orphaned, err := o.RetryDB().GetOrphanedDeposits()
 	if err != nil {
-		t.Fatalf("Failed to get txns: %v", err)
+		t.Fatal(err)
+	}
+	if len(orphaned) != 1 || orphaned[0].Txid != orphan.String() {
+		t.Fatal("deposit from orphaned block should be recorded")
+	}
+}
+
+func TestMempoolObserver(t *testing.T) {
+	o, chain, clean := newTestBtcObserver(t)
+	defer clean()
+	mo, err := observer.NewMempoolObserver(o.Conf(), chain, o.RetryDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Mine(5)
+	txid := chain.InjectDeposit(10000)
+	chain.InjectTx(chain.NewDepositTxToScript([]byte{txscript.OP_TRUE}, 10000))
+	if err = mo.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := o.RetryDB().GetPendingDeposits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Txid != txid.String() || pending[0].Confirmed() {
+		t.Fatal("only the deposit should be pending")
+	}
+
+	chain.Mine(1)
+	block, _, _ := chain.GetBlockByHeight(6)
+	line := make(chan *observer.CrossChainItem, 10)
+	if _, err = o.SearchTxInBlock(block, 6, line); err != nil {
+		t.Fatal(err)
+	}
+	d, err := o.RetryDB().GetPendingDeposit(txid.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Confirmed() || d.Height != 6 || d.FirstSeen == 0 {
+		t.Fatalf("deposit should be confirmed at height 6: %v", d)
 	}
 
-	b, _ := hex.DecodeString(s)
-	str, _ := txscript.DisasmString(b)
+	// evicted from mempool and never confirmed
+	evicted := chain.NewDepositTx(10000)
+	if err = o.RetryDB().PutPendingDeposit(&db.PendingDeposit{
+		Txid:      evicted.TxHash().String(),
+		FirstSeen: time.Now().Add(-time.Duration(observer.DefaultPendingExpiry+1) * time.Hour).Unix(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	mo.Prune()
+	if pending, _ = o.RetryDB().GetPendingDeposits(); len(pending) != 1 || pending[0].Txid != txid.String() {
+		t.Fatal("only the expired deposit should be pruned")
+	}
+}
 
-	fmt.Println(str)
+func encodeTx(t *testing.T, mtx *wire.MsgTx) string {
+	var buf bytes.Buffer
+	if err := mtx.BtcEncode(&buf, wire.ProtocolVersion, wire.LatestEncoding); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(buf.Bytes())
 }
 
-func TestRestCli_BroadcastTx(t *testing.T) {
-	rawtx := "01000000015a93813ac8d05a5a36168d3383ebb23d9c833443132ef4fda34242c7c74b966a020000006a4730440220793143bf61db374c268239646a386af25a25cdf24523089bb5c11c5ed177e3a902200aeb8230a8941ccde68c4cc915bbf657f6cbf58b18665736746db1b162e2152e012103128a2c4525179e47f38cf3fefca37a61548ca4610255b3fb4ee86de2d3e80c0fffffffff03102700000000000017a91487a9652e9b396545598c0fc72cb5a98848bf93d3870000000000000000276a256600000000000000020000000000000000dab47e816313a79c9459b544720c90a725264e0d10684a1f000000001976a91428d2e8cee08857f569e5a1b147c5d5e87339e08188ac00000000"
-	cli := NewRestCli(ADDR, USER, PWD)
-	txid, err := cli.BroadcastTx(rawtx)
+// newTestAllianceObserver builds an observer with conf over fake chains, checking withdrawals
+// against the federation in btcConf, or the default one if nil.
+func newTestAllianceObserver(t *testing.T, conf *observer.AllianceObConfig, btcConf *observer.BtcObConfig) (
+	*observer.AllianceObserver, *testutil.FakeAllianceChain, *testutil.FakeBtcChain, func()) {
+	dir, err := ioutil.TempDir("", "allia_ob")
 	if err != nil {
 		t.Fatal(err)
 	}
+	rdb, err := db.NewRetryDB(dir, 0, 1, 5000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	observer.SleepTime = 1
+	if btcConf == nil {
+		btcConf = &observer.BtcObConfig{NetType: "regtest"}
+	}
+	allia := testutil.NewFakeAllianceChain()
+	chain := testutil.NewFakeBtcChain(&chaincfg.RegressionNetParams)
+	validator, err := observer.NewWithdrawalValidator(chain, btcConf, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := observer.NewAllianceObserver(allia, conf, rdb, validator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o, allia, chain, func() {
+		os.RemoveAll(dir)
+	}
+}
 
-	fmt.Println(txid)
+func TestAllianceObserver_Quarantine(t *testing.T) {
+	o, allia, chain, clean := newTestAllianceObserver(t, &observer.AllianceObConfig{WatchingKey: "btcTxToRelay",
+		NetType: "regtest"}, nil)
+	defer clean()
+	rdb := o.RetryDB()
+	ccm := utils.CrossChainManagerContractAddress.ToHexString()
+
+	deposit := chain.InjectDeposit(10000)
+	other := chain.InjectTx(chain.NewDepositTxToScript([]byte{txscript.OP_TRUE}, 10000))
+	chain.Mine(1)
+	valid := encodeTx(t, chain.NewWithdrawalTx(deposit))
+	allia.EmitWithdrawal(1, valid)
+	allia.EmitNotify(1, ccm, "btcTxToRelay")
+	allia.EmitNotify(1, ccm, "btcTxToRelay", 12)
+	allia.EmitWithdrawal(1, "zz")
+	allia.EmitWithdrawal(1, valid+"00")
+	allia.EmitWithdrawal(1, encodeTx(t, chain.NewWithdrawalTx(other)))
+
+	items, err := o.SearchEventsInBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Tx != valid {
+		t.Fatal("only the valid withdrawal should be captured")
+	}
+	quarantined, err := rdb.GetQuarantinedWithdrawals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 5 {
+		t.Fatalf("5 withdrawals should be quarantined, not %d", len(quarantined))
+	}
+	if !strings.Contains(quarantined[4].Reason, "not a federation output") {
+		t.Fatalf("wrong reason: %s", quarantined[4].Reason)
+	}
+
+	chain.Fail("GetRawTransaction", 1, observer.NetErr{errors.New("connection refused")})
+	if _, err = o.SearchEventsInBlock(1); err == nil {
+		t.Fatal("should fail when btc node is unreachable")
+	}
+	if quarantined, _ = rdb.GetQuarantinedWithdrawals(); len(quarantined) != 5 {
+		t.Fatal("should not quarantine twice")
+	}
+
+	// the spent tx is not seen by the node yet
+	unseen := chain.NewDepositTx(10000)
+	late := encodeTx(t, chain.NewWithdrawalTx(unseen.TxHash()))
+	allia.EmitWithdrawal(2, late)
+	if _, err = o.SearchEventsInBlock(2); err == nil {
+		t.Fatal("should fail when the spent tx is not found")
+	}
+	chain.InjectTx(unseen)
+	chain.Mine(1)
+	if items, err = o.SearchEventsInBlock(2); err != nil || len(items) != 1 || items[0].Tx != late {
+		t.Fatalf("should capture the withdrawal once the spent tx is found: %v", err)
+	}
+	if quarantined, _ = rdb.GetQuarantinedWithdrawals(); len(quarantined) != 5 {
+		t.Fatal("should not quarantine a withdrawal spending a tx not found")
+	}
+}
+
+func TestAllianceObserver_NoTxindex(t *testing.T) {
+	btcOb, chain, clean := newTestBtcObserver(t)
+	defer clean()
+	rdb := btcOb.RetryDB()
+	srv := newBitcoindStandIn(t, chain, false)
+	defer srv.Close()
+	validator, err := observer.NewWithdrawalValidator(observer.NewRestCli(srv.URL, USER, PWD),
+		&observer.BtcObConfig{NetType: "regtest"}, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allia := testutil.NewFakeAllianceChain()
+	o, err := observer.NewAllianceObserver(allia, &observer.AllianceObConfig{WatchingKey: "btcTxToRelay",
+		NetType: "regtest"}, rdb, validator)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// scanned by the observer
+	scanned := chain.InjectDeposit(10000)
+	chain.Mine(1)
+	block, _, _ := chain.GetBlockByHeight(1)
+	if _, err = btcOb.SearchTxInBlock(block, 1, make(chan *observer.CrossChainItem, 10)); err != nil {
+		t.Fatal(err)
+	}
+	// never scanned
+	missed := chain.InjectDeposit(10000)
+	chain.Mine(1)
+	// still in the mempool
+	unconfirmed := chain.InjectDeposit(10000)
+
+	txs := make([]string, 0)
+	for _, deposit := range []chainhash.Hash{scanned, unconfirmed} {
+		txs = append(txs, encodeTx(t, chain.NewWithdrawalTx(deposit)))
+		allia.EmitWithdrawal(1, txs[len(txs)-1])
+	}
+	items, err := o.SearchEventsInBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Tx != txs[0] || items[1].Tx != txs[1] {
+		t.Fatal("should capture withdrawals spending outputs scanned or in the mempool")
+	}
+
+	allia.EmitWithdrawal(2, encodeTx(t, chain.NewWithdrawalTx(missed)))
+	for i := 1; i < observer.MaxTxNotFoundTries; i++ {
+		if _, err = o.SearchEventsInBlock(2); err == nil {
+			t.Fatalf("try %d should fail when the spent tx is not found", i)
+		}
+	}
+	if items, err = o.SearchEventsInBlock(2); err != nil || len(items) != 0 {
+		t.Fatalf("should give up the withdrawal after %d tries: %v", observer.MaxTxNotFoundTries, err)
+	}
+	quarantined, _ := rdb.GetQuarantinedWithdrawals()
+	if len(quarantined) != 1 || quarantined[0].Height != 2 || !strings.Contains(quarantined[0].Reason, "-txindex") {
+		t.Fatal("withdrawal spending a tx not found should be quarantined")
+	}
+}
+
+func TestAllianceObserver_Contracts(t *testing.T) {
+	ccm := utils.CrossChainManagerContractAddress.ToHexString()
+	other := strings.Repeat("ab", 20)
+	o, allia, chain, clean := newTestAllianceObserver(t, &observer.AllianceObConfig{
+		WatchingKeys:     map[string]string{"btcTxToRelay": observer.HANDLER_WITHDRAWAL, "btcTxToRelayV2": observer.HANDLER_WITHDRAWAL},
+		AllowedContracts: []string{"0x" + strings.ToUpper(other)},
+	}, nil)
+	defer clean()
+	rdb, validator := o.RetryDB(), o.Validator()
+	if _, err := observer.NewAllianceObserver(allia, &observer.AllianceObConfig{
+		WatchingKeys: map[string]string{"btcTxToRelay": "unknown"},
+	}, rdb, validator); err == nil {
+		t.Fatal("should fail with unknown handler")
+	}
+	if _, err := observer.NewAllianceObserver(allia, &observer.AllianceObConfig{
+		WatchingKey:      "btcTxToRelay",
+		AllowedContracts: []string{"ccm"},
+	}, rdb, validator); err == nil {
+		t.Fatal("should fail with wrong contract address")
+	}
+
+	txs := make([]string, 3)
+	for i := range txs {
+		txs[i] = encodeTx(t, chain.NewWithdrawalTx(chain.InjectDeposit(10000)))
+	}
+	chain.Mine(1)
+	allia.EmitNotify(1, ccm, "btcTxToRelay", txs[0])
+	allia.EmitNotify(1, other, "btcTxToRelay", txs[1])
+	allia.EmitNotify(1, other, "btcTxToRelayV2", txs[2])
+	allia.EmitNotify(1, other, "otherKey", txs[0])
+
+	items, err := o.SearchEventsInBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Tx != txs[1] || items[1].Tx != txs[2] {
+		t.Fatal("should only capture watched notifies from allowed contracts")
+	}
+	if quarantined, _ := rdb.GetQuarantinedWithdrawals(); len(quarantined) != 0 {
+		t.Fatal("ignored notifies should not be quarantined")
+	}
+}
+
+func TestAllianceObserver_Psbt(t *testing.T) {
+	keys := make([]*btcec.PrivateKey, 3)
+	pubs := make([]*btcutil.AddressPubKey, 3)
+	for i := range keys {
+		keys[i], _ = btcec.NewPrivateKey(btcec.S256())
+		pubs[i], _ = btcutil.NewAddressPubKey(keys[i].PubKey().SerializeCompressed(), &chaincfg.RegressionNetParams)
+	}
+	redeem, err := txscript.MultiSigScript(pubs, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &observer.AllianceObConfig{
+		WatchingKeys: map[string]string{"btcPsbtToRelay": observer.HANDLER_PSBT},
+		NetType:      "regtest",
+	}
+	first, allia, chain, clean := newTestAllianceObserver(t, conf, &observer.BtcObConfig{
+		NetType:           "regtest",
+		FederationScripts: []*observer.FederationScript{{RedeemScript: hex.EncodeToString(redeem)}},
+	})
+	defer clean()
+	rdb, validator := first.RetryDB(), first.Validator()
+	p2sh, p2wsh := validator.PkScripts(0)[0], validator.PkScripts(0)[1]
+	deposits := []chainhash.Hash{
+		chain.InjectTx(chain.NewDepositTxToScript(p2sh, 10000)),
+		chain.InjectTx(chain.NewDepositTxToScript(p2wsh, 20000)),
+	}
+	chain.Mine(1)
+	mtx := wire.NewMsgTx(wire.TxVersion)
+	mtx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&deposits[0], 0), nil, nil))
+	mtx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&deposits[1], 0), nil, nil))
+	mtx.AddTxOut(wire.NewTxOut(25000, []byte{txscript.OP_TRUE}))
+	// signAs signs mtx with key over amount of the p2wsh deposit and claims it's the signature of pub
+	signAs := func(key *btcec.PrivateKey, pub []byte, amount int64) string {
+		p, err := psbt.NewFromUnsignedTx(mtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig0, _ := txscript.RawTxInSignature(mtx, 0, redeem, txscript.SigHashAll, key)
+		sig1, _ := txscript.RawTxInWitnessSignature(mtx, txscript.NewTxSigHashes(mtx), 1, amount, redeem,
+			txscript.SigHashAll, key)
+		p.Inputs[0].PartialSigs = []*psbt.PartialSig{{PubKey: pub, Signature: sig0}}
+		p.Inputs[1].WitnessUtxo = wire.NewTxOut(amount, p2wsh)
+		p.Inputs[1].PartialSigs = []*psbt.PartialSig{{PubKey: pub, Signature: sig1}}
+		b64, err := p.B64Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b64
+	}
+	sign := func(key *btcec.PrivateKey) string {
+		return signAs(key, key.PubKey().SerializeCompressed(), 20000)
+	}
+	ccm := utils.CrossChainManagerContractAddress.ToHexString()
+
+	allia.EmitNotify(2, ccm, "btcPsbtToRelay", signAs(keys[2], keys[2].PubKey().SerializeCompressed(), 1))
+	allia.EmitNotify(2, ccm, "btcPsbtToRelay", signAs(keys[2], keys[1].PubKey().SerializeCompressed(), 20000))
+	allia.EmitNotify(2, ccm, "btcPsbtToRelay", sign(keys[2]))
+	items, err := first.SearchEventsInBlock(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Fatal("should wait for the threshold")
+	}
+	if quarantined, _ := rdb.GetQuarantinedWithdrawals(); len(quarantined) != 2 ||
+		!strings.Contains(quarantined[0].Reason, "witness utxo") ||
+		!strings.Contains(quarantined[1].Reason, "wrong signature") {
+		t.Fatal("wrong amount and forged signature should be quarantined")
+	}
+
+	// collected signatures survive a restart
+	allia.EmitNotify(3, ccm, "btcPsbtToRelay", sign(keys[0]))
+	allia.EmitNotify(3, ccm, "btcPsbtToRelay", sign(keys[1]))
+	o, err := observer.NewAllianceObserver(allia, conf, rdb, validator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		items, err = o.SearchEventsInBlock(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 1 {
+			t.Fatalf("should finalize once threshold is met, got %d items", len(items))
+		}
+		txb, _ := hex.DecodeString(items[0].Tx)
+		signed := wire.NewMsgTx(wire.TxVersion)
+		if err = signed.BtcDecode(bytes.NewBuffer(txb), wire.ProtocolVersion, wire.LatestEncoding); err != nil {
+			t.Fatal(err)
+		}
+		if signed.TxIn[1].PreviousOutPoint != mtx.TxIn[1].PreviousOutPoint || len(signed.TxIn[0].SignatureScript) == 0 ||
+			len(signed.TxIn[1].Witness) != 4 {
+			t.Fatal("wrong finalized tx")
+		}
+	}
+	if quarantined, _ := rdb.GetQuarantinedWithdrawals(); len(quarantined) != 2 {
+		t.Fatal("signatures after threshold should be ignored")
+	}
+}
+
+func TestAllianceObserver_Listen(t *testing.T) {
+	conf := &observer.AllianceObConfig{
+		AlliaObLoopWaitTime: 1,
+		WatchingKey:         "btcTxToRelay",
+		NetType:             "regtest",
+		WaitingCycle:        1,
+	}
+	o, allia, chain, clean := newTestAllianceObserver(t, conf, nil)
+	defer clean()
+	rdb := o.RetryDB()
+	collecting := make(chan *observer.FromAllianceItem, 10)
+
+	txs := make([]string, 2)
+	for i := range txs {
+		deposit := chain.InjectDeposit(10000)
+		txs[i] = encodeTx(t, chain.NewWithdrawalTx(deposit))
+	}
+	chain.Mine(1)
+	allia.SetHeight(3)
+	allia.FailPost("GetSmartContractEventByBlock", 1)
+	allia.EmitWithdrawal(2, txs[0])
+	allia.EmitNotify(3, "", "otherKey", "ccdd")
+	allia.EmitWithdrawal(4, txs[1])
+	go o.Listen(collecting)
+
+	for _, tx := range txs {
+		select {
+		case item := <-collecting:
+			if item.Tx != tx {
+				t.Fatalf("wrong tx %s, should be %s", item.Tx, tx)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting for withdrawal")
+		}
+	}
+	for i := 0; i < 50 && rdb.GetAlliaHeight() < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if rdb.GetAlliaHeight() != 4 || rdb.GetBtcHeight() != 0 {
+		t.Fatal("alliance cursor should not touch btc cursor")
+	}
+
+	// not done with the first one before restart
+	outbox, _ := rdb.GetAlliaOutbox()
+	rdb.DelAlliaOutbox(outbox[1].Key)
+	collecting = make(chan *observer.FromAllianceItem, 10)
+	o, err := observer.NewAllianceObserver(allia, conf, rdb, o.Validator())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go o.Listen(collecting)
+	select {
+	case item := <-collecting:
+		if item.Tx != txs[0] || !bytes.Equal(item.Key, outbox[0].Key) {
+			t.Fatalf("wrong tx %s resumed from outbox", item.Tx)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for withdrawal in outbox")
+	}
+	select {
+	case item := <-collecting:
+		t.Fatalf("%s should not be captured again", item.Tx)
+	case <-time.After(2 * time.Second):
+	}
+}
+
+func TestAllianceObserver_ListenWs(t *testing.T) {
+	push := make(chan interface{})
+	conns := int32(0)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		atomic.AddInt32(&conns, 1)
+		req := &observer.WsSubscribeReq{}
+		if err := conn.ReadJSON(req); err != nil || req.Action != observer.WS_ACTION_SUBSCRIBE || !req.SubscribeBlockTxHashs {
+			t.Errorf("wrong subscription %v: %v", req, err)
+			return
+		}
+		for msg := range push {
+			if msg == nil {
+				return
+			}
+			if err := conn.WriteJSON(msg); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	o, allia, chain, clean := newTestAllianceObserver(t, &observer.AllianceObConfig{
+		AlliaObLoopWaitTime: 1,
+		WatchingKey:         "btcTxToRelay",
+		NetType:             "regtest",
+		AllianceWsAddress:   "ws" + strings.TrimPrefix(srv.URL, "http"),
+	}, nil)
+	defer clean()
+	collecting := make(chan *observer.FromAllianceItem, 10)
+	txs := make([]string, 5)
+	for i := range txs {
+		txs[i] = encodeTx(t, chain.NewWithdrawalTx(chain.InjectDeposit(10000)))
+	}
+	chain.Mine(1)
+	block := func(height uint32, hashes ...string) {
+		result, _ := json.Marshal(&observer.WsBlockTxHashes{Height: height, TxHashes: hashes})
+		push <- &observer.WsMessage{Action: observer.WS_ACTION_BLOCK_TXHASHES, Result: result}
+	}
+	expect := func(txs ...string) {
+		for _, tx := range txs {
+			select {
+			case item := <-collecting:
+				if item.Tx != tx {
+					t.Fatalf("wrong tx %s, should be %s", item.Tx, tx)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("timeout waiting for withdrawal")
+			}
+		}
+	}
+
+	// caught up after connecting
+	allia.EmitWithdrawal(2, txs[0])
+	go o.Listen(collecting)
+	expect(txs[0])
+
+	// loaded from the node when pushed, whatever pushed before
+	allia.EmitWithdrawal(3, txs[1])
+	push <- &observer.WsMessage{Action: "Notify", Result: json.RawMessage(`{}`)}
+	block(3, "t3")
+	expect(txs[1])
+
+	// the gap at height 4 is filled too
+	allia.EmitWithdrawal(4, txs[2])
+	allia.EmitWithdrawal(5, txs[3])
+	block(5, "t5")
+	expect(txs[2], txs[3])
+
+	// polled when the connection is lost
+	push <- nil
+	allia.EmitWithdrawal(6, txs[4])
+	expect(txs[4])
+
+	// and pushed again after reconnecting
+	allia.SetHeight(7)
+	block(7)
+	for i := 0; i < 50 && o.RetryDB().GetAlliaHeight() < 7; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if o.RetryDB().GetAlliaHeight() != 7 || atomic.LoadInt32(&conns) != 2 {
+		t.Fatalf("cursor should be 7 after reconnecting, not %d", o.RetryDB().GetAlliaHeight())
+	}
+}
+
+func TestRestCli_GetBlocksByHeightRange(t *testing.T) {
+	chain := testutil.NewFakeBtcChain(&chaincfg.RegressionNetParams)
+	chain.InjectDeposit(10000)
+	chain.Mine(5)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs := make([]observer.Request, 0)
+		if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+			t.Fatal(err)
+		}
+		resps := make([]*observer.Response, 0)
+		for i := len(reqs) - 1; i >= 0; i-- {
+			resp := &observer.Response{Id: reqs[i].Id}
+			switch reqs[i].Method {
+			case "getblockhash":
+				hash, err := chain.GetBlockHash(uint32(reqs[i].Params[0].(float64)))
+				if err != nil {
+					resp.Error = &btcjson.RPCError{Code: btcjson.ErrRPCInvalidParameter, Message: err.Error()}
+				}
+				resp.Result = hash
+			case "getblock":
+				for h := uint32(0); h <= chain.Height(); h++ {
+					block, hash, _ := chain.GetBlockByHeight(h)
+					if hash == reqs[i].Params[0].(string) {
+						var buf bytes.Buffer
+						block.BtcEncode(&buf, wire.ProtocolVersion, wire.LatestEncoding)
+						resp.Result = hex.EncodeToString(buf.Bytes())
+					}
+				}
+			}
+			resps = append(resps, resp)
+		}
+		json.NewEncoder(w).Encode(resps)
+	}))
+	defer srv.Close()
+
+	cli := observer.NewRestCli(srv.URL, USER, PWD)
+	blocks, hashes, err := cli.GetBlocksByHeightRange(2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 4 || len(hashes) != 4 {
+		t.Fatal("should get 4 blocks")
+	}
+	for i, block := range blocks {
+		hash, _ := chain.GetBlockHash(uint32(i + 2))
+		if block.BlockHash().String() != hash || hashes[i] != hash {
+			t.Fatalf("block at height %d not right", i+2)
+		}
+	}
+
+	blocks, hashes, err = cli.GetBlocksByHeightRange(4, 7)
+	if err == nil {
+		t.Fatal("err should not be nil")
+	}
+	if len(blocks) != 2 || len(hashes) != 2 {
+		t.Fatal("blocks before the failed entry should be returned")
+	}
+}
+
+func newEsploraStandIn(t *testing.T, chain *testutil.FakeBtcChain) *httptest.Server {
+	findBlock := func(hash string) *wire.MsgBlock {
+		for h := uint32(0); h <= chain.Height(); h++ {
+			block, bh, _ := chain.GetBlockByHeight(h)
+			if bh == hash {
+				return block
+			}
+		}
+		return nil
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case r.URL.Path == "/blocks/tip/height":
+			fmt.Fprintf(w, "%d", chain.Height())
+		case parts[0] == "block-height":
+			h, _ := strconv.Atoi(parts[1])
+			hash, err := chain.GetBlockHash(uint32(h))
+			if err != nil {
+				http.Error(w, "Block not found", http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, hash)
+		case parts[0] == "block" && len(parts) == 3 && parts[2] == "raw":
+			block := findBlock(parts[1])
+			if block == nil {
+				http.Error(w, "Block not found", http.StatusNotFound)
+				return
+			}
+			block.BtcEncode(w, wire.ProtocolVersion, wire.LatestEncoding)
+		case parts[0] == "blocks" && len(parts) == 2:
+			top, _ := strconv.Atoi(parts[1])
+			if uint32(top) > chain.Height() {
+				top = int(chain.Height())
+			}
+			blocks := make([]map[string]interface{}, 0)
+			for h := top; h >= 0 && h > top-10; h-- {
+				block, hash, _ := chain.GetBlockByHeight(uint32(h))
+				b := map[string]interface{}{
+					"id":          hash,
+					"height":      h,
+					"version":     block.Header.Version,
+					"timestamp":   block.Header.Timestamp.Unix(),
+					"bits":        block.Header.Bits,
+					"nonce":       block.Header.Nonce,
+					"merkle_root": block.Header.MerkleRoot.String(),
+				}
+				if h > 0 {
+					b["previousblockhash"] = block.Header.PrevBlock.String()
+				}
+				blocks = append(blocks, b)
+			}
+			json.NewEncoder(w).Encode(blocks)
+		case parts[0] == "tx" && len(parts) == 3 && parts[2] == "merkleblock-proof":
+			proof, err := chain.GetProof([]string{parts[1]})
+			if err != nil {
+				http.Error(w, "Transaction not found", http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, proof)
+		case r.URL.Path == "/tx" && r.Method == http.MethodPost:
+			body, _ := ioutil.ReadAll(r.Body)
+			txid, err := chain.BroadcastTx(string(body))
+			if err != nil {
+				http.Error(w, `sendrawtransaction RPC error: {"code":-26,"message":"bad-txns"}`, http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, txid)
+		case parts[0] == "tx" && len(parts) == 2:
+			spk, err := chain.GetScriptPubKey(parts[1], 0)
+			if err != nil {
+				http.Error(w, "Transaction not found", http.StatusNotFound)
+				return
+			}
+			fmt.Fprintf(w, `{"txid":"%s","vout":[{"scriptpubkey":"%s","value":10000}]}`, parts[1], spk)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestMultiCli(t *testing.T) {
+	observer.SleepTime = 1
+	a := testutil.NewFakeBtcChain(&chaincfg.RegressionNetParams)
+	b := testutil.NewFakeBtcChain(&chaincfg.RegressionNetParams)
+	c := testutil.NewFakeBtcChain(&chaincfg.RegressionNetParams)
+	for _, chain := range []*testutil.FakeBtcChain{a, b, c} {
+		chain.Mine(3)
+	}
+	c.Reorg(1, 1)
+
+	m, err := observer.NewMultiCli([]string{"a", "b"}, []observer.BtcClient{a, b}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Fail("GetBlockHash", 1, observer.NetErr{errors.New("connection refused")})
+	hash, err := m.GetBlockHash(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := b.GetBlockHash(2); hash != want {
+		t.Fatal("wrong hash from failover")
+	}
+	if m.Names()[0] != "b" {
+		t.Fatal("failed endpoint should be tried last")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if m.Names()[0] != "a" {
+		t.Fatal("failed endpoint should be back after backoff")
+	}
+
+	a.Fail("BroadcastTx", 1, observer.NeedToRetryErr{errors.New("missing inputs")})
+	if _, err = m.BroadcastTx(txArrHex); err == nil {
+		t.Fatal("err should not be nil")
+	}
+	if len(b.Broadcasted()) != 0 {
+		t.Fatal("should not fail over on NeedToRetryErr")
+	}
+
+	m, _ = observer.NewMultiCli([]string{"a", "b", "c"}, []observer.BtcClient{a, b, c}, 2)
+	blocks, _, err := m.GetBlocksByHeightRange(1, 3)
+	if err != nil || len(blocks) != 3 {
+		t.Fatalf("should get blocks agreed by a and b: %v", err)
+	}
+	m, _ = observer.NewMultiCli([]string{"c", "a"}, []observer.BtcClient{c, a}, 2)
+	if _, _, err = m.GetBlockByHeight(3); err == nil {
+		t.Fatal("should fail without quorum")
+	}
+	if _, _, err = m.GetBlockByHeight(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = observer.NewMultiCli([]string{"a"}, []observer.BtcClient{a}, 2); err == nil {
+		t.Fatal("quorum should not exceed endpoints")
+	}
+
+	// the endpoint out of quorum is charged, not the one failed over from
+	m, _ = observer.NewMultiCli([]string{"c", "a", "b"}, []observer.BtcClient{c, a, b}, 2)
+	blocks, hashes, err := m.GetBlocksByHeightRange(1, 3)
+	if want, _ := a.GetBlockHash(3); err != nil || len(blocks) != 3 || hashes[2] != want {
+		t.Fatalf("should get blocks agreed by a and b: %v", err)
+	}
+	if m.Failures()[0] != 1 || m.Failures()[1] != 0 || m.Failures()[2] != 0 {
+		t.Fatal("only c should be charged for disagreeing")
+	}
+
+	if _, err = observer.NewBtcClient(&observer.BtcObConfig{BtcJsonRpcAddress: "http://127.0.0.1:18443", BtcQuorum: 2}); err == nil {
+		t.Fatal("quorum should need endpoints")
+	}
+}
+
+func TestEsploraCli(t *testing.T) {
+	o, chain, clean := newTestBtcObserver(t)
+	defer clean()
+	srv := newEsploraStandIn(t, chain)
+	defer srv.Close()
+	cli := observer.NewEsploraCli(srv.URL + "/")
+	o.SetCli(cli, 2, 2)
+	chain.Mine(5)
+	line := make(chan *observer.CrossChainItem, 10)
+	go o.Listen(line)
+
+	txid := chain.InjectDeposit(10000)
+	chain.Mine(1)
+	item := waitItem(t, line)
+	if item.Txid != txid || item.Height != 6 {
+		t.Fatalf("wrong item: %s at %d", item.Txid.String(), item.Height)
+	}
+
+	block, blockHash, _ := chain.GetBlockByHeight(6)
+	h, hash, err := cli.GetCurrentHeightAndHash()
+	if err != nil || h != 6 || hash != blockHash {
+		t.Fatalf("wrong tip: %d, %s, %v", h, hash, err)
+	}
+	proof, err := cli.GetProof([]string{txid.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pb, _ := hex.DecodeString(proof); !bytes.Equal(pb, item.Proof) {
+		t.Fatal("proof from esplora should be the same as the local one")
+	}
+	spk, err := cli.GetScriptPubKey(txid.String(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spk != hex.EncodeToString(block.Transactions[1].TxOut[0].PkScript) {
+		t.Fatal("wrong scriptPubKey")
+	}
+	if _, err = cli.BroadcastTx(txArrHex); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.BroadcastTx("00"); err == nil {
+		t.Fatal("err should not be nil")
+	} else if _, ok := err.(observer.NeedToRetryErr); !ok {
+		t.Fatalf("should be NeedToRetryErr: %v", err)
+	}
+	if _, _, err = cli.GetBlockByHeight(100); err == nil {
+		t.Fatal("err should not be nil")
+	}
+
+	chain.Mine(20)
+	headers, err := cli.GetBlockHeaders(3, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 23 {
+		t.Fatalf("want 23 headers, got %d", len(headers))
+	}
+	for i, header := range headers {
+		if want, _ := chain.GetBlockHash(uint32(3 + i)); header.BlockHash().String() != want {
+			t.Fatalf("wrong header at height %d", 3+i)
+		}
+	}
+	if _, err = cli.GetBlockHeaders(20, 30); err == nil {
+		t.Fatal("should fail on headers above the tip")
+	}
+}
+
+func TestRestCli_GetScriptPubKey(t *testing.T) {
+	chain := testutil.NewFakeBtcChain(&chaincfg.RegressionNetParams)
+	deposit := chain.NewDepositTx(10000)
+	txid := chain.InjectTx(deposit)
+	chain.Mine(1)
+	srv := newBitcoindStandIn(t, chain, true)
+	defer srv.Close()
+
+	cli := observer.NewRestCli(srv.URL, USER, PWD)
+	for i, out := range deposit.TxOut {
+		s, err := cli.GetScriptPubKey(txid.String(), uint32(i))
+		if err != nil {
+			t.Fatalf("Failed to get scriptPubKey: %v", err)
+		}
+		if s != hex.EncodeToString(out.PkScript) {
+			t.Fatalf("wrong scriptPubKey of output %d: %s", i, s)
+		}
+	}
+	if _, err := cli.GetScriptPubKey(txid.String(), uint32(len(deposit.TxOut))); err == nil {
+		t.Fatal("err should not be nil")
+	}
+	_, err := cli.GetScriptPubKey(chain.NewDepositTx(20000).TxHash().String(), 0)
+	if _, ok := err.(observer.TxNotFoundErr); !ok {
+		t.Fatalf("should be TxNotFoundErr: %v", err)
+	}
+}
+
+func TestRestCli_BroadcastTx(t *testing.T) {
+	chain := testutil.NewFakeBtcChain(&chaincfg.RegressionNetParams)
+	srv := newBitcoindStandIn(t, chain, true)
+	defer srv.Close()
+
+	cli := observer.NewRestCli(srv.URL, USER, PWD)
+	mtx := chain.NewWithdrawalTx(chain.InjectDeposit(10000))
+	txid, err := cli.BroadcastTx(encodeTx(t, mtx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txid != mtx.TxHash().String() || len(chain.Broadcasted()) != 1 {
+		t.Fatalf("wrong broadcast %s", txid)
+	}
+	chain.Fail("BroadcastTx", 1, errors.New("missing inputs"))
+	if _, err = cli.BroadcastTx(encodeTx(t, mtx)); err == nil {
+		t.Fatal("err should not be nil")
+	} else if _, ok := err.(observer.NeedToRetryErr); !ok {
+		t.Fatalf("should be NeedToRetryErr: %v", err)
+	}
 }
@@ -0,0 +1,64 @@
+package observer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/ontio/multi-chain/native/service/cross_chain_manager/btc"
+)
+
+const (
+	payloadFlagLen    = 1
+	payloadChainIdLen = 8
+	payloadFeeLen     = 8
+	payloadHeaderLen  = payloadFlagLen + payloadChainIdLen + payloadFeeLen
+)
+
+// DepositPayload is the data a depositor puts in the OP_RETURN output:
+// flag(1 byte) | target chain id(8 bytes, big endian) | fee(8 bytes, big endian) | destination address
+type DepositPayload struct {
+	ToChainId uint64
+	Fee       int64
+	ToAddress []byte
+}
+
+func ParseDepositPayload(pkScript []byte) (*DepositPayload, error) {
+	if len(pkScript) < 2 || pkScript[0] != txscript.OP_RETURN {
+		return nil, fmt.Errorf("not an OP_RETURN script")
+	}
+	if txscript.GetScriptClass(pkScript) != txscript.NullDataTy {
+		return nil, fmt.Errorf("not a standard null data script")
+	}
+	pushes, err := txscript.PushedData(pkScript)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse OP_RETURN script: %v", err)
+	}
+	if len(pushes) != 1 {
+		return nil, fmt.Errorf("OP_RETURN script should push exactly one data, not %d", len(pushes))
+	}
+	data := pushes[0]
+	if len(data) <= payloadHeaderLen {
+		return nil, fmt.Errorf("payload too short: %d bytes", len(data))
+	}
+	if data[0] != btc.OP_RETURN_SCRIPT_FLAG {
+		return nil, fmt.Errorf("wrong flag %x, should be %x", data[0], btc.OP_RETURN_SCRIPT_FLAG)
+	}
+
+	p := &DepositPayload{
+		ToChainId: binary.BigEndian.Uint64(data[payloadFlagLen : payloadFlagLen+payloadChainIdLen]),
+		Fee:       int64(binary.BigEndian.Uint64(data[payloadFlagLen+payloadChainIdLen : payloadHeaderLen])),
+		ToAddress: data[payloadHeaderLen:],
+	}
+	if p.Fee < 0 {
+		return nil, fmt.Errorf("negative fee %d", p.Fee)
+	}
+	if p.ToChainId == BTC_ID {
+		return nil, fmt.Errorf("target chain id can't be btc itself")
+	}
+
+	return p, nil
+}
+
+func (p *DepositPayload) String() string {
+	return fmt.Sprintf("to chain %d, fee %d, address %x", p.ToChainId, p.Fee, p.ToAddress)
+}
@@ -0,0 +1,47 @@
+package observer
+
+import (
+	"fmt"
+)
+
+// DepositPolicy decides which deposits are worth relaying. Zero values disable the checks on
+// amount, target chain and gas cost, but a deposit whose fee is not less than its amount is
+// always refused.
+type DepositPolicy struct {
+	MinAmount       int64    `json:"min_amount"`        // satoshis
+	MaxAmount       int64    `json:"max_amount"`        // satoshis
+	AllowedChainIds []uint64 `json:"allowed_chain_ids"` // target chains
+	AllianceGasCost int64    `json:"alliance_gas_cost"` // minimum fee in the payload
+}
+
+func (policy *DepositPolicy) Check(value int64, payload *DepositPayload) error {
+	if payload.Fee >= value {
+		return fmt.Errorf("fee %d is not less than amount %d", payload.Fee, value)
+	}
+	if policy == nil {
+		return nil
+	}
+	if value < policy.MinAmount {
+		return fmt.Errorf("amount %d is less than minimum %d", value, policy.MinAmount)
+	}
+	if policy.MaxAmount > 0 && value > policy.MaxAmount {
+		return fmt.Errorf("amount %d is more than maximum %d", value, policy.MaxAmount)
+	}
+	if len(policy.AllowedChainIds) > 0 {
+		allowed := false
+		for _, id := range policy.AllowedChainIds {
+			if id == payload.ToChainId {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("target chain %d is not allowed", payload.ToChainId)
+		}
+	}
+	if payload.Fee < policy.AllianceGasCost {
+		return fmt.Errorf("fee %d can't cover alliance gas cost %d", payload.Fee, policy.AllianceGasCost)
+	}
+
+	return nil
+}
@@ -0,0 +1,260 @@
+package observer
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/ontio/btcrelayer/db"
+	"github.com/ontio/btcrelayer/log"
+	"strings"
+)
+
+const HANDLER_PSBT = "psbt"
+
+// ParsePsbtEvent decodes the states of a notify, which should be the watching key and a base64
+// PSBT carrying the partial signatures of a federation member.
+func ParsePsbtEvent(states []interface{}) (*psbt.Packet, error) {
+	if len(states) < 2 {
+		return nil, fmt.Errorf("need at least 2 states but got %d", len(states))
+	}
+	raw, ok := states[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("psbt should be a base64 string, not %T", states[1])
+	}
+	p, err := psbt.NewFromRawBytes(strings.NewReader(raw), true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode psbt: %v", err)
+	}
+	if len(p.UnsignedTx.TxIn) == 0 || len(p.UnsignedTx.TxOut) == 0 {
+		return nil, fmt.Errorf("tx has %d inputs and %d outputs", len(p.UnsignedTx.TxIn), len(p.UnsignedTx.TxOut))
+	}
+	return p, nil
+}
+
+// handlePsbt merges the partial signatures emitted by a federation member into the ones
+// collected for the same withdrawal, which are kept in db across restarts. Once every input
+// has as many signatures as its redeem script requires, the tx is finalized and returned. The
+// notify completing it returns the tx again when captured twice, later ones are ignored.
+func handlePsbt(observer *AllianceObserver, height, index uint32, states []interface{}) (*FromAllianceItem, error) {
+	p, err := ParsePsbtEvent(states)
+	if err != nil {
+		return nil, err
+	}
+	outs, err := observer.validator.spent(p.UnsignedTx, p.Inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	txid := p.UnsignedTx.TxHash().String()
+	w, err := observer.retryDB.GetPartialWithdrawal(txid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get signatures collected for %s: %v", txid, err)
+	}
+	var collected *psbt.Packet
+	if w == nil {
+		w = &db.PartialWithdrawal{Txid: txid}
+		if collected, err = psbt.NewFromUnsignedTx(p.UnsignedTx); err != nil {
+			return nil, err
+		}
+	} else {
+		if collected, err = psbt.NewFromRawBytes(bytes.NewReader(w.Psbt), false); err != nil {
+			return nil, fmt.Errorf("failed to decode signatures collected for %s: %v", txid, err)
+		}
+		if w.Completed() {
+			if w.CompletedAt != height || w.CompletedIndex != index {
+				log.Infof("[AllianceObserver] withdrawal %s is already completed, ignore more signatures", txid)
+				return nil, nil
+			}
+			return finalizePsbt(collected, outs)
+		}
+	}
+	if err = mergePsbt(collected, p, outs); err != nil {
+		return nil, err
+	}
+
+	item, err := finalizePsbt(collected, outs)
+	if err != nil {
+		return nil, err
+	}
+	if item != nil {
+		w.CompletedAt, w.CompletedIndex = height, index
+	}
+	var buf bytes.Buffer
+	if err = collected.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	w.Psbt = buf.Bytes()
+	if err = observer.retryDB.PutPartialWithdrawal(w); err != nil {
+		return nil, fmt.Errorf("failed to save signatures collected for %s: %v", txid, err)
+	}
+	if item == nil {
+		log.Infof("[AllianceObserver] collected signatures for withdrawal %s, waiting for more", txid)
+	}
+	return item, nil
+}
+
+// mergePsbt adds the valid signatures in p not yet in collected. It fails if p has no
+// signature or an invalid one, or a witness utxo other than the output spent.
+func mergePsbt(collected, p *psbt.Packet, outs []*spentOutput) error {
+	sigHashes := txscript.NewTxSigHashes(p.UnsignedTx)
+	total := 0
+	for i := range p.Inputs {
+		in := &collected.Inputs[i]
+		if utxo := p.Inputs[i].WitnessUtxo; utxo != nil {
+			if utxo.Value != outs[i].value || !bytes.Equal(utxo.PkScript, outs[i].pkScript) {
+				return fmt.Errorf("witness utxo of input %d pays %d to %x, but the spent output pays %d to %x", i,
+					utxo.Value, utxo.PkScript, outs[i].value, outs[i].pkScript)
+			}
+			if in.WitnessUtxo == nil {
+				in.WitnessUtxo = utxo
+			} else if in.WitnessUtxo.Value != utxo.Value || !bytes.Equal(in.WitnessUtxo.PkScript, utxo.PkScript) {
+				return fmt.Errorf("witness utxo of input %d differs from the one collected", i)
+			}
+		}
+		for _, ps := range p.Inputs[i].PartialSigs {
+			total++
+			if hasPartialSig(in, ps.PubKey) {
+				continue
+			}
+			if err := verifyPartialSig(p.UnsignedTx, i, outs[i], in, sigHashes, ps); err != nil {
+				return fmt.Errorf("signature of %x for input %d: %v", ps.PubKey, i, err)
+			}
+			in.PartialSigs = append(in.PartialSigs, ps)
+		}
+	}
+	if total == 0 {
+		return fmt.Errorf("no signature in psbt")
+	}
+	return nil
+}
+
+func hasPartialSig(in *psbt.PInput, pubKey []byte) bool {
+	for _, ps := range in.PartialSigs {
+		if bytes.Equal(ps.PubKey, pubKey) {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyPartialSig(mtx *wire.MsgTx, i int, out *spentOutput, in *psbt.PInput, sigHashes *txscript.TxSigHashes,
+	ps *psbt.PartialSig) error {
+	if !isMultiSigKey(out.fs.redeem, ps.PubKey) {
+		return fmt.Errorf("not a key of the federation")
+	}
+	if len(ps.Signature) == 0 {
+		return fmt.Errorf("empty signature")
+	}
+	hashType := txscript.SigHashType(ps.Signature[len(ps.Signature)-1])
+	var hash []byte
+	var err error
+	if out.fs.isWitness(out.pkScript) {
+		if in.WitnessUtxo == nil {
+			return fmt.Errorf("no witness utxo for the spent output")
+		}
+		hash, err = txscript.CalcWitnessSigHash(out.fs.redeem, sigHashes, hashType, mtx, i, out.value)
+	} else {
+		hash, err = txscript.CalcSignatureHash(out.fs.redeem, hashType, mtx, i)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to calculate signature hash: %v", err)
+	}
+	sig, err := btcec.ParseDERSignature(ps.Signature[:len(ps.Signature)-1], btcec.S256())
+	if err != nil {
+		return fmt.Errorf("failed to parse signature: %v", err)
+	}
+	pub, err := btcec.ParsePubKey(ps.PubKey, btcec.S256())
+	if err != nil {
+		return fmt.Errorf("failed to parse public key: %v", err)
+	}
+	if !sig.Verify(hash, pub) {
+		return fmt.Errorf("wrong signature")
+	}
+	return nil
+}
+
+// isMultiSigKey tells if pubKey is one of the keys in the multisig redeem script.
+func isMultiSigKey(redeem, pubKey []byte) bool {
+	pushes, err := txscript.PushedData(redeem)
+	if err != nil {
+		return false
+	}
+	for _, data := range pushes {
+		if bytes.Equal(data, pubKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// finalizePsbt builds the scriptSig and witness of every input from the collected signatures,
+// taking as many as the redeem script requires in the order of its keys. It returns nil if
+// some input doesn't have enough signatures yet.
+func finalizePsbt(p *psbt.Packet, outs []*spentOutput) (*FromAllianceItem, error) {
+	mtx := p.UnsignedTx.Copy()
+	for i, out := range outs {
+		_, required, err := txscript.CalcMultiSigStats(out.fs.redeem)
+		if err != nil {
+			return nil, fmt.Errorf("federation script is not multisig: %v", err)
+		}
+		pushes, err := txscript.PushedData(out.fs.redeem)
+		if err != nil {
+			return nil, err
+		}
+		sigs := make([][]byte, 0, required)
+		for _, key := range pushes {
+			for _, ps := range p.Inputs[i].PartialSigs {
+				if len(sigs) < required && bytes.Equal(ps.PubKey, key) {
+					sigs = append(sigs, ps.Signature)
+				}
+			}
+		}
+		if len(sigs) < required {
+			return nil, nil
+		}
+
+		if !out.fs.isWitness(out.pkScript) {
+			builder := txscript.NewScriptBuilder().AddOp(txscript.OP_FALSE)
+			for _, sig := range sigs {
+				builder.AddData(sig)
+			}
+			if mtx.TxIn[i].SignatureScript, err = builder.AddData(out.fs.redeem).Script(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		witness := wire.TxWitness{nil}
+		witness = append(witness, sigs...)
+		mtx.TxIn[i].Witness = append(witness, out.fs.redeem)
+		if txscript.IsPayToScriptHash(out.pkScript) {
+			// p2sh-p2wsh pushes the p2wsh script
+			if mtx.TxIn[i].SignatureScript, err = txscript.NewScriptBuilder().AddData(
+				out.fs.pkScripts[1]).Script(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sigHashes := txscript.NewTxSigHashes(mtx)
+	for i, out := range outs {
+		vm, err := txscript.NewEngine(out.pkScript, mtx, i, txscript.StandardVerifyFlags, nil, sigHashes, out.value)
+		if err == nil {
+			err = vm.Execute()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("finalized input %d is not valid: %v", i, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := mtx.BtcEncode(&buf, wire.ProtocolVersion, wire.LatestEncoding); err != nil {
+		return nil, err
+	}
+	return &FromAllianceItem{
+		Tx: hex.EncodeToString(buf.Bytes()),
+	}, nil
+}
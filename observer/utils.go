@@ -7,12 +7,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/btcsuite/btcd/btcjson"
-	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
-	"github.com/btcsuite/btcutil"
-	"github.com/ontio/multi-chain/native/service/cross_chain_manager/btc"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -26,21 +23,26 @@ const (
 )
 
 var (
-	SleepTime time.Duration = 10
+	SleepTime           time.Duration = 10
+	DefaultBatchSize    uint32        = 50
+	DefaultFetchWorkers               = 4
 )
 
 type CrossChainItem struct {
-	Tx     []byte
-	Proof  []byte
-	Height uint32
-	Txid   chainhash.Hash
+	Tx      []byte
+	Proof   []byte
+	Height  uint32
+	Txid    chainhash.Hash
+	Payload *DepositPayload
+	Key     []byte // key in the relay queue, nil if not from there
 }
 
 type FromAllianceItem struct {
-	Tx string
+	Tx  string
+	Key []byte // key in the outbox, nil if not from there
 }
 
-func checkIfCrossChainTx(tx *wire.MsgTx, netParam *chaincfg.Params) bool {
+func checkIfCrossChainTx(tx *wire.MsgTx, fed *federation, height uint32) bool {
 	if len(tx.TxOut) < 2 {
 		return false
 	}
@@ -48,15 +50,11 @@ func checkIfCrossChainTx(tx *wire.MsgTx, netParam *chaincfg.Params) bool {
 		return false
 	}
 
-	redeem, _ := hex.DecodeString(REDEEM_SCRIPT_HEX)
 	c1 := txscript.GetScriptClass(tx.TxOut[0].PkScript)
-	if c1 == txscript.ScriptHashTy {
-		addr, _ := btcutil.NewAddressScriptHash(redeem, netParam)
-		h, _ := txscript.PayToAddrScript(addr)
-		if !bytes.Equal(h, tx.TxOut[0].PkScript) {
-			return false
-		}
-	} else {
+	if c1 != txscript.ScriptHashTy && c1 != txscript.WitnessV0ScriptHashTy {
+		return false
+	}
+	if fed.match(tx.TxOut[0].PkScript, height) == nil {
 		return false
 	}
 
@@ -64,13 +62,21 @@ func checkIfCrossChainTx(tx *wire.MsgTx, netParam *chaincfg.Params) bool {
 	if c2 != txscript.NullDataTy {
 		return false
 	}
-	if tx.TxOut[1].PkScript[2] != btc.OP_RETURN_SCRIPT_FLAG {
-		return false
-	}
 
 	return true
 }
 
+// serializeTxNoWitness encodes tx without witness data, which is what the txid commits to and
+// what the alliance verifies against the merkle proof.
+func serializeTxNoWitness(tx *wire.MsgTx) ([]byte, error) {
+	var buf bytes.Buffer
+	err := tx.BtcEncode(&buf, wire.ProtocolVersion, wire.BaseEncoding)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 type Request struct {
 	Jsonrpc string        `json:"jsonrpc"`
 	Method  string        `json:"method"`
@@ -110,7 +116,7 @@ func NewRestCli(addr, user, pwd string) *RestCli {
 	}
 }
 
-func (cli *RestCli) sendPostReq(req []byte) (*Response, error) {
+func (cli *RestCli) post(req []byte) ([]byte, error) {
 	resp, err := cli.Cli.Post(cli.Addr, "application/json;charset=UTF-8",
 		bytes.NewReader(req))
 	if err != nil {
@@ -121,6 +127,14 @@ func (cli *RestCli) sendPostReq(req []byte) (*Response, error) {
 	if err != nil {
 		return nil, fmt.Errorf("read response body error:%s", err)
 	}
+	return body, nil
+}
+
+func (cli *RestCli) sendPostReq(req []byte) (*Response, error) {
+	body, err := cli.post(req)
+	if err != nil {
+		return nil, err
+	}
 
 	response := new(Response)
 	err = json.Unmarshal(body, &response)
@@ -130,6 +144,148 @@ func (cli *RestCli) sendPostReq(req []byte) (*Response, error) {
 	return response, nil
 }
 
+// SendBatch posts all requests in one JSON-RPC batch and returns the responses in the order
+// of reqs. Failure of a single entry is reported in its Response.Error.
+func (cli *RestCli) SendBatch(reqs []Request) ([]*Response, error) {
+	for i := range reqs {
+		reqs[i].Id = i + 1
+	}
+	req, err := json.Marshal(reqs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal batch request: %v", err)
+	}
+	body, err := cli.post(req)
+	if err != nil {
+		return nil, err
+	}
+
+	arr := make([]*Response, 0, len(reqs))
+	err = json.Unmarshal(body, &arr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal batch response: %v", err)
+	}
+	res := make([]*Response, len(reqs))
+	for _, r := range arr {
+		if r == nil || r.Id < 1 || r.Id > len(reqs) {
+			continue
+		}
+		res[r.Id-1] = r
+	}
+	for i, r := range res {
+		if r == nil {
+			return nil, fmt.Errorf("no response for request %d(%s)", i+1, reqs[i].Method)
+		}
+	}
+	return res, nil
+}
+
+func (cli *RestCli) GetBlockHashes(start, end uint32) ([]string, error) {
+	reqs := make([]Request, 0, end-start+1)
+	for h := start; h <= end; h++ {
+		reqs = append(reqs, Request{
+			Jsonrpc: "1.0",
+			Method:  "getblockhash",
+			Params:  []interface{}{h},
+		})
+	}
+	resps, err := cli.SendBatch(reqs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send batch: %v", err)
+	}
+
+	hashes := make([]string, 0, len(resps))
+	for i, resp := range resps {
+		if resp.Error != nil {
+			return hashes, fmt.Errorf("response for height %d shows failure: %v", start+uint32(i), resp.Error.Message)
+		}
+		hashes = append(hashes, resp.Result.(string))
+	}
+	return hashes, nil
+}
+
+func (cli *RestCli) GetBlocks(hashes []string) ([]*wire.MsgBlock, error) {
+	reqs := make([]Request, 0, len(hashes))
+	for _, hash := range hashes {
+		reqs = append(reqs, Request{
+			Jsonrpc: "1.0",
+			Method:  "getblock",
+			Params:  []interface{}{hash, false},
+		})
+	}
+	resps, err := cli.SendBatch(reqs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send batch: %v", err)
+	}
+
+	blocks := make([]*wire.MsgBlock, 0, len(resps))
+	for i, resp := range resps {
+		if resp.Error != nil {
+			return blocks, fmt.Errorf("response for block %s shows failure: %v", hashes[i], resp.Error.Message)
+		}
+		bb, err := hex.DecodeString(resp.Result.(string))
+		if err != nil {
+			return blocks, fmt.Errorf("failed to decode hex string of block %s: %v", hashes[i], err)
+		}
+		block := &wire.MsgBlock{}
+		err = block.BtcDecode(bytes.NewBuffer(bb), wire.ProtocolVersion, wire.LatestEncoding)
+		if err != nil {
+			return blocks, fmt.Errorf("failed to decode block %s: %v", hashes[i], err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func (cli *RestCli) GetBlockHeaders(start, end uint32) ([]*wire.BlockHeader, error) {
+	hashes, err := cli.GetBlockHashes(start, end)
+	if err != nil {
+		return nil, err
+	}
+	reqs := make([]Request, 0, len(hashes))
+	for _, hash := range hashes {
+		reqs = append(reqs, Request{
+			Jsonrpc: "1.0",
+			Method:  "getblockheader",
+			Params:  []interface{}{hash, false},
+		})
+	}
+	resps, err := cli.SendBatch(reqs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send batch: %v", err)
+	}
+
+	headers := make([]*wire.BlockHeader, 0, len(resps))
+	for i, resp := range resps {
+		if resp.Error != nil {
+			return nil, fmt.Errorf("response for header %s shows failure: %v", hashes[i], resp.Error.Message)
+		}
+		hb, err := hex.DecodeString(resp.Result.(string))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode hex string of header %s: %v", hashes[i], err)
+		}
+		header := &wire.BlockHeader{}
+		if err = header.Deserialize(bytes.NewBuffer(hb)); err != nil {
+			return nil, fmt.Errorf("failed to decode header %s: %v", hashes[i], err)
+		}
+		headers = append(headers, header)
+	}
+	return headers, nil
+}
+
+// GetBlocksByHeightRange fetches blocks from start to end with two batch requests. When an entry
+// fails, the blocks before it are still returned together with the error.
+func (cli *RestCli) GetBlocksByHeightRange(start, end uint32) ([]*wire.MsgBlock, []string, error) {
+	hashes, err := cli.GetBlockHashes(start, end)
+	if len(hashes) == 0 {
+		return nil, nil, err
+	}
+	blocks, berr := cli.GetBlocks(hashes)
+	if berr != nil {
+		err = berr
+	}
+	return blocks, hashes[:len(blocks)], err
+}
+
 func (cli *RestCli) GetProof(txids []string) (string, error) {
 	req, err := json.Marshal(Request{
 		Jsonrpc: "1.0",
@@ -152,7 +308,7 @@ func (cli *RestCli) GetProof(txids []string) (string, error) {
 	return resp.Result.(string), nil
 }
 
-func (cli *RestCli) GetTxsInBlock(hash string) ([]*wire.MsgTx, string, error) {
+func (cli *RestCli) GetBlock(hash string) (*wire.MsgBlock, error) {
 	req, err := json.Marshal(Request{
 		Jsonrpc: "1.0",
 		Method:  "getblock",
@@ -160,32 +316,41 @@ func (cli *RestCli) GetTxsInBlock(hash string) ([]*wire.MsgTx, string, error) {
 		Id:      1,
 	})
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to marshal request: %v", err)
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
 	}
 
 	resp, err := cli.sendPostReq(req)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to send post: %v", err)
+		return nil, fmt.Errorf("failed to send post: %v", err)
 	}
 	if resp.Error != nil {
-		return nil, "", fmt.Errorf("response shows failure: %v", resp.Error.Message)
+		return nil, fmt.Errorf("response shows failure: %v", resp.Error.Message)
 	}
 	bhex := resp.Result.(string)
 	bb, err := hex.DecodeString(bhex)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to decode hex string: %v", err)
+		return nil, fmt.Errorf("failed to decode hex string: %v", err)
 	}
 
-	block := wire.MsgBlock{}
+	block := &wire.MsgBlock{}
 	err = block.BtcDecode(bytes.NewBuffer(bb), wire.ProtocolVersion, wire.LatestEncoding)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to decode block: %v", err)
+		return nil, fmt.Errorf("failed to decode block: %v", err)
+	}
+
+	return block, nil
+}
+
+func (cli *RestCli) GetTxsInBlock(hash string) ([]*wire.MsgTx, string, error) {
+	block, err := cli.GetBlock(hash)
+	if err != nil {
+		return nil, "", err
 	}
 
 	return block.Transactions, block.Header.PrevBlock.String(), nil
 }
 
-func (cli *RestCli) GetTxsInBlockByHeight(height uint32) ([]*wire.MsgTx, string, error) {
+func (cli *RestCli) GetBlockHash(height uint32) (string, error) {
 	req, err := json.Marshal(Request{
 		Jsonrpc: "1.0",
 		Method:  "getblockhash",
@@ -193,23 +358,40 @@ func (cli *RestCli) GetTxsInBlockByHeight(height uint32) ([]*wire.MsgTx, string,
 		Id:      1,
 	})
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to marshal request: %v", err)
+		return "", fmt.Errorf("failed to marshal request: %v", err)
 	}
 
 	resp, err := cli.sendPostReq(req)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to send post: %v", err)
+		return "", fmt.Errorf("failed to send post: %v", err)
 	}
 	if resp.Error != nil {
-		return nil, "", fmt.Errorf("response shows failure: %v", resp.Error.Message)
+		return "", fmt.Errorf("response shows failure: %v", resp.Error.Message)
+	}
+
+	return resp.Result.(string), nil
+}
+
+func (cli *RestCli) GetBlockByHeight(height uint32) (*wire.MsgBlock, string, error) {
+	hash, err := cli.GetBlockHash(height)
+	if err != nil {
+		return nil, "", err
+	}
+	block, err := cli.GetBlock(hash)
+	if err != nil {
+		return nil, "", fmt.Errorf("fail to invoke GetBlock: %v", err)
 	}
-	hash := resp.Result.(string)
-	txns, _, err := cli.GetTxsInBlock(hash)
+
+	return block, hash, nil
+}
+
+func (cli *RestCli) GetTxsInBlockByHeight(height uint32) ([]*wire.MsgTx, string, error) {
+	block, hash, err := cli.GetBlockByHeight(height)
 	if err != nil {
-		return nil, "", fmt.Errorf("fail to invoke GetTxsInBlock")
+		return nil, "", err
 	}
 
-	return txns, hash, nil
+	return block.Transactions, hash, nil
 }
 
 func (cli *RestCli) GetCurrentHeightAndHash() (uint32, string, error) {
@@ -231,8 +413,150 @@ func (cli *RestCli) GetCurrentHeightAndHash() (uint32, string, error) {
 		return 0, "", fmt.Errorf("response shows failure: %v", resp.Error.Message)
 	}
 
-	m := resp.Result.([]interface{})[0].(map[string]interface{})
-	return uint32(m["height"].(float64)), m["hash"].(string), nil
+	for _, tip := range resp.Result.([]interface{}) {
+		m := tip.(map[string]interface{})
+		if m["status"] == "active" {
+			return uint32(m["height"].(float64)), m["hash"].(string), nil
+		}
+	}
+	return 0, "", fmt.Errorf("no active tip found in chain tips")
+}
+
+type ChainInfo struct {
+	Blocks               uint32 `json:"blocks"`
+	Headers              uint32 `json:"headers"`
+	BestBlockHash        string `json:"bestblockhash"`
+	InitialBlockDownload bool   `json:"initialblockdownload"`
+}
+
+// maxHeadersAhead is how many headers the node may have beyond its blocks while synced, since
+// a new block is announced by its header before it's validated.
+const maxHeadersAhead = 3
+
+func (info *ChainInfo) IsSynced() bool {
+	return !info.InitialBlockDownload && info.Headers <= info.Blocks+maxHeadersAhead
+}
+
+func (cli *RestCli) GetChainInfo() (*ChainInfo, error) {
+	req, err := json.Marshal(Request{
+		Jsonrpc: "1.0",
+		Method:  "getblockchaininfo",
+		Params:  nil,
+		Id:      1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	body, err := cli.post(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send post: %v", err)
+	}
+	resp := struct {
+		Result *ChainInfo        `json:"result"`
+		Error  *btcjson.RPCError `json:"error"`
+	}{}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("response shows failure: %v", resp.Error.Message)
+	}
+	if resp.Result == nil {
+		return nil, fmt.Errorf("no result in response")
+	}
+	return resp.Result, nil
+}
+
+func (cli *RestCli) GetRawMempool() ([]string, error) {
+	req, err := json.Marshal(Request{
+		Jsonrpc: "1.0",
+		Method:  "getrawmempool",
+		Params:  nil,
+		Id:      1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	resp, err := cli.sendPostReq(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send post: %v", err)
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("response shows failure: %v", resp.Error.Message)
+	}
+
+	txids := make([]string, 0)
+	for _, txid := range resp.Result.([]interface{}) {
+		txids = append(txids, txid.(string))
+	}
+	return txids, nil
+}
+
+// GetRawTransaction returns TxNotFoundErr for the txs the node doesn't know.
+func (cli *RestCli) GetRawTransaction(txid string) (*wire.MsgTx, error) {
+	req, err := json.Marshal(Request{
+		Jsonrpc: "1.0",
+		Method:  "getrawtransaction",
+		Params:  []interface{}{txid, false},
+		Id:      1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	resp, err := cli.sendPostReq(req)
+	if err != nil {
+		if _, ok := err.(NetErr); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to send post: %v", err)
+	}
+	if resp.Error != nil {
+		if resp.Error.Code == btcjson.ErrRPCInvalidAddressOrKey {
+			// confirmed txs are only found with -txindex
+			return nil, TxNotFoundErr{fmt.Errorf("tx %s not found: %v", txid, resp.Error.Message)}
+		}
+		return nil, fmt.Errorf("response shows failure: %v", resp.Error.Message)
+	}
+	txb, err := hex.DecodeString(resp.Result.(string))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode hex string: %v", err)
+	}
+
+	mtx := wire.NewMsgTx(wire.TxVersion)
+	if err = mtx.BtcDecode(bytes.NewBuffer(txb), wire.ProtocolVersion, wire.LatestEncoding); err != nil {
+		return nil, fmt.Errorf("failed to decode tx: %v", err)
+	}
+	return mtx, nil
+}
+
+// GetTxConfirmations returns 0 for txs in the mempool and TxNotFoundErr for the ones the node
+// doesn't know. Txs in blocks are only found with -txindex.
+func (cli *RestCli) GetTxConfirmations(txid string) (uint32, error) {
+	req, err := json.Marshal(Request{
+		Jsonrpc: "1.0",
+		Method:  "getrawtransaction",
+		Params:  []interface{}{txid, true},
+		Id:      1,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	resp, err := cli.sendPostReq(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send post: %v", err)
+	}
+	if resp.Error != nil {
+		if resp.Error.Code == btcjson.ErrRPCInvalidAddressOrKey {
+			return 0, TxNotFoundErr{fmt.Errorf("tx %s not found: %v", txid, resp.Error.Message)}
+		}
+		return 0, fmt.Errorf("response shows failure: %v", resp.Error.Message)
+	}
+	confs, _ := resp.Result.(map[string]interface{})["confirmations"].(float64)
+	return uint32(confs), nil
 }
 
 func (cli *RestCli) GetScriptPubKey(txid string, index uint32) (string, error) {
@@ -248,13 +572,24 @@ func (cli *RestCli) GetScriptPubKey(txid string, index uint32) (string, error) {
 
 	resp, err := cli.sendPostReq(req)
 	if err != nil {
+		if _, ok := err.(NetErr); ok {
+			return "", NetErr{fmt.Errorf("[GetScriptPubKey] failed to send post: %v", err)}
+		}
 		return "", fmt.Errorf("[GetScriptPubKey] failed to send post: %v", err)
 	}
 	if resp.Error != nil {
+		if resp.Error.Code == btcjson.ErrRPCInvalidAddressOrKey {
+			// confirmed txs are only found with -txindex, and the tx may not be seen yet
+			return "", TxNotFoundErr{fmt.Errorf("[GetScriptPubKey] tx %s not found: %v", txid, resp.Error.Message)}
+		}
 		return "", fmt.Errorf("[GetScriptPubKey] response shows failure: %v", resp.Error.Message)
 	}
 
-	return resp.Result.(map[string]interface{})["vout"].([]interface{})[index].(map[string]interface{})["scriptPubKey"].(map[string]interface{})["hex"].(string), nil
+	vout := resp.Result.(map[string]interface{})["vout"].([]interface{})
+	if int(index) >= len(vout) {
+		return "", fmt.Errorf("[GetScriptPubKey] tx %s has no output %d", txid, index)
+	}
+	return vout[index].(map[string]interface{})["scriptPubKey"].(map[string]interface{})["hex"].(string), nil
 }
 
 func (cli *RestCli) BroadcastTx(tx string) (string, error) {
@@ -270,10 +605,17 @@ func (cli *RestCli) BroadcastTx(tx string) (string, error) {
 
 	resp, err := cli.sendPostReq(req)
 	if err != nil {
+		if _, ok := err.(NetErr); ok {
+			return "", NetErr{fmt.Errorf("[BroadcastTx] failed to send post: %v", err)}
+		}
 		return "", fmt.Errorf("[BroadcastTx] failed to send post: %v", err)
 	}
 	if resp.Error != nil {
 		switch resp.Error.Code {
+		case btcjson.ErrRPCTxAlreadyInChain:
+			return "", TxInChainErr{
+				Err: fmt.Errorf("[BroadcastTx] response shows failure: code:%d; %v", resp.Error.Code, resp.Error.Message),
+			}
 		case btcjson.ErrRPCTxError:
 			return "", NeedToRetryErr{
 				Err: fmt.Errorf("[BroadcastTx] response shows failure and retry: code:%d; %v", resp.Error.Code, resp.Error.Message),
@@ -309,3 +651,22 @@ type NetErr struct {
 func (err NetErr) Error() string {
 	return err.Err.Error()
 }
+
+// TxInChainErr means the tx to broadcast is already confirmed.
+type TxInChainErr struct {
+	Err error
+}
+
+func (err TxInChainErr) Error() string {
+	return err.Err.Error()
+}
+
+// TxNotFoundErr means the node doesn't know the tx, it may be unconfirmed yet or the node may
+// run without -txindex.
+type TxNotFoundErr struct {
+	Err error
+}
+
+func (err TxNotFoundErr) Error() string {
+	return err.Err.Error()
+}
@@ -0,0 +1,168 @@
+package observer
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/ontio/btcrelayer/db"
+	"github.com/ontio/btcrelayer/log"
+)
+
+const HANDLER_WITHDRAWAL = "withdrawal"
+
+// notifyHandler turns the states of the index-th watched notify at height into an item to
+// broadcast, or nil if there's nothing to broadcast yet. It returns NetErr or TxNotFoundErr
+// when the notify can't be checked for now, any other error gets the notify quarantined.
+type notifyHandler func(observer *AllianceObserver, height, index uint32, states []interface{}) (
+	*FromAllianceItem, error)
+
+var notifyHandlers = map[string]notifyHandler{
+	HANDLER_WITHDRAWAL: handleWithdrawal,
+	HANDLER_PSBT:       handlePsbt,
+}
+
+func handleWithdrawal(observer *AllianceObserver, height, index uint32, states []interface{}) (
+	*FromAllianceItem, error) {
+	ev, err := ParseWithdrawalEvent(states)
+	if err != nil {
+		return nil, err
+	}
+	if err = observer.validator.Check(ev); err != nil {
+		return nil, err
+	}
+	return &FromAllianceItem{
+		Tx: ev.RawTx,
+	}, nil
+}
+
+// WithdrawalEvent is a notify of the alliance asking to broadcast a btc tx.
+type WithdrawalEvent struct {
+	Key   string
+	RawTx string
+	Tx    *wire.MsgTx
+}
+
+// ParseWithdrawalEvent decodes the states of a notify, which should be the watching key and
+// the hex of a btc tx.
+func ParseWithdrawalEvent(states []interface{}) (*WithdrawalEvent, error) {
+	if len(states) < 2 {
+		return nil, fmt.Errorf("need at least 2 states but got %d", len(states))
+	}
+	key, ok := states[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("key should be a string, not %T", states[0])
+	}
+	raw, ok := states[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("tx should be a hex string, not %T", states[1])
+	}
+	txb, err := hex.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("tx is not hex: %v", err)
+	}
+	mtx := wire.NewMsgTx(wire.TxVersion)
+	buf := bytes.NewBuffer(txb)
+	if err = mtx.BtcDecode(buf, wire.ProtocolVersion, wire.LatestEncoding); err != nil {
+		return nil, fmt.Errorf("failed to decode tx: %v", err)
+	}
+	if buf.Len() > 0 {
+		return nil, fmt.Errorf("%d bytes left after tx", buf.Len())
+	}
+	if len(mtx.TxIn) == 0 || len(mtx.TxOut) == 0 {
+		return nil, fmt.Errorf("tx has %d inputs and %d outputs", len(mtx.TxIn), len(mtx.TxOut))
+	}
+
+	return &WithdrawalEvent{
+		Key:   key,
+		RawTx: raw,
+		Tx:    mtx,
+	}, nil
+}
+
+// WithdrawalValidator checks that withdrawals only spend federation outputs.
+type WithdrawalValidator struct {
+	cli     BtcClient
+	fed     *federation
+	retryDB *db.RetryDB
+}
+
+func NewWithdrawalValidator(cli BtcClient, conf *BtcObConfig, rdb *db.RetryDB) (*WithdrawalValidator, error) {
+	fed, err := newFederation(conf.FederationScripts, getNetParam(conf.NetType))
+	if err != nil {
+		return nil, fmt.Errorf("failed to new federation: %v", err)
+	}
+	return &WithdrawalValidator{
+		cli:     cli,
+		fed:     fed,
+		retryDB: rdb,
+	}, nil
+}
+
+// Check returns NetErr when the btc node is unreachable and TxNotFoundErr when a spent tx is
+// not found, which may show up later. Any other error means the withdrawal is invalid.
+func (v *WithdrawalValidator) Check(ev *WithdrawalEvent) error {
+	_, err := v.spent(ev.Tx, nil)
+	return err
+}
+
+type spentOutput struct {
+	pkScript []byte
+	value    int64
+	fs       *federationScript
+}
+
+// spent returns the federation outputs spent by the inputs of mtx. An output is taken from the
+// ones recorded by the observer, then from the NonWitnessUtxo of the input in inputs if any, and
+// only fetched from the node when both miss, since a node without -txindex only finds the txs
+// in its mempool.
+func (v *WithdrawalValidator) spent(mtx *wire.MsgTx, inputs []psbt.PInput) ([]*spentOutput, error) {
+	outs := make([]*spentOutput, len(mtx.TxIn))
+	for i, in := range mtx.TxIn {
+		var nonWitness *wire.MsgTx
+		if i < len(inputs) {
+			nonWitness = inputs[i].NonWitnessUtxo
+		}
+		out, err := v.findOutput(in.PreviousOutPoint, nonWitness)
+		if err != nil {
+			switch err.(type) {
+			case NetErr, TxNotFoundErr:
+				return nil, err
+			}
+			return nil, fmt.Errorf("failed to get output spent by input %d: %v", i, err)
+		}
+		fs := v.fed.owner(out.PkScript)
+		if fs == nil {
+			return nil, fmt.Errorf("input %d spends %s, which is not a federation output", i,
+				in.PreviousOutPoint.String())
+		}
+		outs[i] = &spentOutput{
+			pkScript: out.PkScript,
+			value:    out.Value,
+			fs:       fs,
+		}
+	}
+	return outs, nil
+}
+
+func (v *WithdrawalValidator) findOutput(op wire.OutPoint, nonWitness *wire.MsgTx) (*wire.TxOut, error) {
+	txid := op.Hash.String()
+	u, err := v.retryDB.GetFederationUtxo(txid, op.Index)
+	if err != nil {
+		log.Errorf("[WithdrawalValidator] failed to get recorded output %s: %v", op.String(), err)
+	} else if u != nil {
+		return wire.NewTxOut(u.Value, u.PkScript), nil
+	}
+
+	prev := nonWitness
+	if prev == nil || prev.TxHash() != op.Hash {
+		if prev, err = v.cli.GetRawTransaction(txid); err != nil {
+			return nil, err
+		}
+	}
+	if int(op.Index) >= len(prev.TxOut) {
+		return nil, fmt.Errorf("tx %s has no output %d", txid, op.Index)
+	}
+	return prev.TxOut[op.Index], nil
+}
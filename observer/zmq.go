@@ -0,0 +1,98 @@
+package observer
+
+import (
+	"context"
+	"github.com/go-zeromq/zmq4"
+	"github.com/ontio/btcrelayer/log"
+	"time"
+)
+
+const (
+	ZMQ_HASHBLOCK = "hashblock"
+	ZMQ_RAWBLOCK  = "rawblock"
+	ZMQ_RAWTX     = "rawtx"
+)
+
+type ZmqMsg struct {
+	Topic string
+	Body  []byte
+}
+
+// ZmqSubscriber receives the notifications published by bitcoind with -zmqpub* options. Messages
+// are dropped when nobody reads them in time, so it only works as a hint and callers need to
+// keep polling.
+type ZmqSubscriber struct {
+	addr   string
+	topics []string
+	msgs   chan *ZmqMsg
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewZmqSubscriber(addr string, topics ...string) *ZmqSubscriber {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ZmqSubscriber{
+		addr:   addr,
+		topics: topics,
+		msgs:   make(chan *ZmqMsg, 16),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (sub *ZmqSubscriber) Messages() <-chan *ZmqMsg {
+	return sub.msgs
+}
+
+func (sub *ZmqSubscriber) Start() {
+	go func() {
+		for {
+			err := sub.subscribe()
+			select {
+			case <-sub.ctx.Done():
+				return
+			default:
+			}
+			log.Errorf("[ZmqSubscriber] subscription to %s broken, reconnect after %d sec: %v", sub.addr, SleepTime, err)
+			select {
+			case <-time.After(time.Second * SleepTime):
+			case <-sub.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (sub *ZmqSubscriber) Stop() {
+	sub.cancel()
+}
+
+func (sub *ZmqSubscriber) subscribe() error {
+	sock := zmq4.NewSub(sub.ctx)
+	defer sock.Close()
+
+	if err := sock.Dial(sub.addr); err != nil {
+		return err
+	}
+	for _, topic := range sub.topics {
+		if err := sock.SetOption(zmq4.OptionSubscribe, topic); err != nil {
+			return err
+		}
+	}
+	log.Infof("[ZmqSubscriber] subscribed %v from %s", sub.topics, sub.addr)
+
+	for {
+		msg, err := sock.Recv()
+		if err != nil {
+			return err
+		}
+		if len(msg.Frames) < 2 {
+			continue
+		}
+		select {
+		case sub.msgs <- &ZmqMsg{Topic: string(msg.Frames[0]), Body: msg.Frames[1]}:
+		default:
+			log.Tracef("[ZmqSubscriber] drop %s message, channel is full", msg.Frames[0])
+		}
+	}
+}
@@ -14,19 +14,25 @@ import (
 	"github.com/ontio/multi-chain/common/password"
 	"io/ioutil"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
+// ImportConfirmRounds is how many rounds of SleepTime to wait for an import to be executed.
+var ImportConfirmRounds = 10
+
 type BtcRelayer struct {
 	btcOb      *observer.BtcObserver
+	mempoolOb  *observer.MempoolObserver
 	alliaOb    *observer.AllianceObserver
 	account    *sdk.Account
 	relaying   chan *observer.CrossChainItem
 	collecting chan *observer.FromAllianceItem
-	allia      *sdk.MultiChainSdk
+	allia      observer.AllianceClient
 	config     *RelayerConfig
-	cli        *observer.RestCli
+	cli        observer.BtcClient
 	retryDB    *db.RetryDB
+	duplicates uint64
 }
 
 func NewBtcRelayer(conf *RelayerConfig) (*BtcRelayer, error) {
@@ -46,14 +52,38 @@ func NewBtcRelayer(conf *RelayerConfig) (*BtcRelayer, error) {
 		return nil, fmt.Errorf("failed to new retry db: %v", err)
 	}
 
-	cli := observer.NewRestCli(conf.BtcObConf.BtcJsonRpcAddress, conf.BtcObConf.User, conf.BtcObConf.Pwd)
+	cli, err := observer.NewBtcClient(conf.BtcObConf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new btc client: %v", err)
+	}
+	btcOb, err := observer.NewBtcObserver(conf.BtcObConf, cli, rdb)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new btc observer: %v", err)
+	}
+	var mempoolOb *observer.MempoolObserver
+	if conf.BtcObConf.BtcMempoolWatch {
+		mempoolOb, err = observer.NewMempoolObserver(conf.BtcObConf, cli, rdb)
+		if err != nil {
+			return nil, fmt.Errorf("failed to new mempool observer: %v", err)
+		}
+	}
+	validator, err := observer.NewWithdrawalValidator(cli, conf.BtcObConf, rdb)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new withdrawal validator: %v", err)
+	}
+	alliaCli := observer.NewAllianceClient(allia)
+	alliaOb, err := observer.NewAllianceObserver(alliaCli, conf.AlliaObConf, rdb, validator)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new alliance observer: %v", err)
+	}
 	return &BtcRelayer{
-		btcOb:      observer.NewBtcObserver(conf.BtcObConf, cli, rdb),
-		alliaOb:    observer.NewAllianceObserver(allia, conf.AlliaObConf, rdb),
+		btcOb:      btcOb,
+		mempoolOb:  mempoolOb,
+		alliaOb:    alliaOb,
 		account:    acct,
 		relaying:   make(chan *observer.CrossChainItem, 10),
 		collecting: make(chan *observer.FromAllianceItem, 10),
-		allia:      allia,
+		allia:      alliaCli,
 		config:     conf,
 		cli:        cli,
 		retryDB:    rdb,
@@ -64,6 +94,13 @@ func (relayer *BtcRelayer) BtcListen() {
 	relayer.btcOb.Listen(relayer.relaying)
 }
 
+func (relayer *BtcRelayer) MempoolListen() {
+	if relayer.mempoolOb == nil {
+		return
+	}
+	relayer.mempoolOb.Listen()
+}
+
 func (relayer *BtcRelayer) AllianceListen() {
 	relayer.alliaOb.Listen(relayer.collecting)
 }
@@ -122,26 +159,59 @@ func (relayer *BtcRelayer) Broadcast() {
 				log.Infof("[BtcRelayer] need to rebroadcast this tx %s...%s: %v", item.Tx[:16], item.Tx[len(item.Tx)-16:], err)
 				err = relayer.retryDB.Put(item.Tx)
 				if err != nil {
+					// keep it in outbox, so it's sent again after restart
 					log.Errorf("[BtcRelayer] failed to put tx in db: %v", err)
+					continue
 				}
 			case observer.NetErr:
 				relayer.collecting <- item
 				log.Errorf("[BtcRelayer] net err happened, put it(%s...%s) back to channel: %v", item.Tx[:16],
 					item.Tx[len(item.Tx)-16:], err)
 				<-time.Tick(time.Second * observer.SleepTime)
+				continue
 			default:
 				log.Errorf("[BtcRelayer] failed to broadcast tx: %v", err)
 			}
-			continue
+		} else {
+			log.Infof("[BtcRelayer] broadcast tx: %s", txid)
 		}
-		log.Infof("[BtcRelayer] broadcast tx: %s", txid)
+		relayer.doneWithOutbox(item)
+	}
+}
+
+func (relayer *BtcRelayer) doneWithOutbox(item *observer.FromAllianceItem) {
+	if item.Key == nil {
+		return
+	}
+	if err := relayer.retryDB.DelAlliaOutbox(item.Key); err != nil {
+		log.Errorf("[BtcRelayer] failed to delete tx %s...%s from outbox: %v", item.Tx[:16],
+			item.Tx[len(item.Tx)-16:], err)
 	}
 }
 
+// Relay imports the deposits to the alliance. A deposit stays in the relay queue until its
+// import is confirmed, and is skipped once dropped from the queue by a reorg. The ones refused
+// by the alliance are moved to the failed deposits, which are relayed again after ReplayFailed.
 func (relayer *BtcRelayer) Relay() {
 	for item := range relayer.relaying {
-		log.Infof("[BtcRelayer] ralaying an item: txid: %s, height: %d", item.Txid, item.Height)
-		txHash, err := relayer.allia.Native.Ccm.ImportOuterTransfer(observer.BTC_ID, item.Txid[:], item.Tx, uint32(item.Height),
+		log.Infof("[BtcRelayer] ralaying an item: txid: %s, height: %d, %s", item.Txid, item.Height, item.Payload)
+		if !relayer.queued(item) {
+			log.Warnf("[BtcRelayer] %s at height %d left the relay queue, its block is orphaned, skip it",
+				item.Txid.String(), item.Height)
+			continue
+		}
+		imported, err := relayer.imported(item)
+		if err != nil {
+			log.Warnf("[BtcRelayer] failed to check if %s is imported, relay it anyway: %v", item.Txid.String(), err)
+		}
+		if imported {
+			n := atomic.AddUint64(&relayer.duplicates, 1)
+			log.Infof("[BtcRelayer] %s at height %d is already imported, skip it (%d duplicates so far)",
+				item.Txid.String(), item.Height, n)
+			relayer.doneWithQueue(item)
+			continue
+		}
+		txHash, err := relayer.allia.ImportOuterTransfer(observer.BTC_ID, item.Txid[:], item.Tx, uint32(item.Height),
 			item.Proof, relayer.account.Address[:], relayer.account)
 		if err != nil {
 			switch err.(type) {
@@ -153,11 +223,288 @@ func (relayer *BtcRelayer) Relay() {
 				<-time.Tick(time.Second * observer.SleepTime)
 			default:
 				log.Errorf("[BtcRelayer] invokeNativeContract error: %v", err)
+				relayer.failImport(item, err.Error())
 			}
 			continue
 		}
 		log.Infof("[BtcRelayer] %s sent to alliance : txid: %s, height: %d", txHash.ToHexString(),
 			item.Txid, item.Height)
+		go relayer.waitImported(item, txHash.ToHexString())
+	}
+}
+
+// waitImported acks item once its import is executed on the alliance. It's relayed again if
+// not executed in ImportConfirmRounds rounds, the alliance refuses it if the first import
+// lands later.
+func (relayer *BtcRelayer) waitImported(item *observer.CrossChainItem, txHash string) {
+	executed, err := relayer.confirmImport(item, txHash)
+	if err != nil {
+		log.Errorf("[BtcRelayer] %v", err)
+		relayer.failImport(item, err.Error())
+		return
+	}
+	if !executed {
+		log.Warnf("[BtcRelayer] import %s of %s not confirmed after %d rounds, relay it again", txHash,
+			item.Txid.String(), ImportConfirmRounds)
+		relayer.relaying <- item
+		return
+	}
+	relayer.doneWithQueue(item)
+}
+
+// confirmImport polls the import txHash of item for ImportConfirmRounds rounds, and tells if
+// it's executed. Executed imports are put into the imported index, failed ones are returned
+// as error.
+func (relayer *BtcRelayer) confirmImport(item *observer.CrossChainItem, txHash string) (bool, error) {
+	for i := 0; i < ImportConfirmRounds; i++ {
+		<-time.After(time.Second * observer.SleepTime)
+		e, err := relayer.allia.GetSmartContractEvent(txHash)
+		if err != nil {
+			log.Errorf("[BtcRelayer] failed to get event of %s: %v", txHash, err)
+			continue
+		}
+		if e == nil {
+			continue
+		}
+		if e.State != 1 {
+			return false, fmt.Errorf("import %s of %s failed on alliance", txHash, item.Txid.String())
+		}
+		log.Infof("[BtcRelayer] import %s of %s confirmed", txHash, item.Txid.String())
+		relayer.markImported(item, txHash)
+		return true, nil
+	}
+	return false, nil
+}
+
+// imported tells if item is already imported, by the local index first and then the alliance.
+// Those found on chain are put into the index.
+func (relayer *BtcRelayer) imported(item *observer.CrossChainItem) (bool, error) {
+	d, err := relayer.retryDB.GetImportedDeposit(item.Txid.String())
+	if err != nil {
+		log.Errorf("[BtcRelayer] failed to get %s from imported index: %v", item.Txid.String(), err)
+	}
+	if d != nil {
+		return true, nil
+	}
+	imported, err := observer.CheckIfImported(relayer.allia, item.Txid[:])
+	if err != nil || !imported {
+		return false, err
+	}
+	relayer.markImported(item, "")
+	return true, nil
+}
+
+func (relayer *BtcRelayer) markImported(item *observer.CrossChainItem, txHash string) {
+	err := relayer.retryDB.PutImportedDeposit(&db.ImportedDeposit{
+		Txid:           item.Txid.String(),
+		AllianceTxHash: txHash,
+		Height:         item.Height,
+		ImportedAt:     time.Now().Unix(),
+	})
+	if err != nil {
+		log.Errorf("[BtcRelayer] failed to put %s into imported index: %v", item.Txid.String(), err)
+	}
+}
+
+// Duplicates returns how many deposits Relay skipped as already imported.
+func (relayer *BtcRelayer) Duplicates() uint64 {
+	return atomic.LoadUint64(&relayer.duplicates)
+}
+
+// queued tells if item is still in the relay queue. The deposits of orphaned blocks are dropped
+// from the queue by the observer, but may be on the way to Relay already. Items not from the
+// queue are always relayed.
+func (relayer *BtcRelayer) queued(item *observer.CrossChainItem) bool {
+	if item.Key == nil {
+		return true
+	}
+	in, err := relayer.retryDB.InRelayQueue(item.Key, item.Txid.String())
+	if err != nil {
+		log.Errorf("[BtcRelayer] failed to check if %s is in relay queue, relay it anyway: %v", item.Txid.String(), err)
+		return true
+	}
+	return in
+}
+
+func (relayer *BtcRelayer) doneWithQueue(item *observer.CrossChainItem) {
+	if item.Key == nil {
+		return
+	}
+	if err := relayer.retryDB.DelRelayQueue(item.Key); err != nil {
+		log.Errorf("[BtcRelayer] failed to delete deposit %s from relay queue: %v", item.Txid.String(), err)
+	}
+}
+
+// failImport moves item to the failed deposits, where it stays until replayed.
+func (relayer *BtcRelayer) failImport(item *observer.CrossChainItem, reason string) {
+	if item.Key == nil {
+		return
+	}
+	if err := relayer.retryDB.FailRelayQueue(item.Key, reason); err != nil {
+		log.Errorf("[BtcRelayer] failed to move deposit %s to failed deposits: %v", item.Txid.String(), err)
+	}
+}
+
+// FailedDeposits returns the deposits the alliance refused to import.
+func (relayer *BtcRelayer) FailedDeposits() ([]*db.FailedDeposit, error) {
+	return relayer.retryDB.GetFailedDeposits()
+}
+
+// PendingDeposits returns the deposits seen in the mempool and not expired yet, confirmed or not.
+func (relayer *BtcRelayer) PendingDeposits() ([]*db.PendingDeposit, error) {
+	return relayer.retryDB.GetPendingDeposits()
+}
+
+// ReplayFailed puts the failed deposits back into the relay queue, so they're relayed on the
+// next start.
+func (relayer *BtcRelayer) ReplayFailed() (int, error) {
+	return relayer.retryDB.ReplayFailedDeposits()
+}
+
+// Rescan searches the btc blocks in [from, to] again and relays the deposits that are not
+// imported to the alliance yet. A deposit counts as relayed once its import is executed, and
+// is put into the imported index like Relay does. The btc cursor is not touched.
+func (relayer *BtcRelayer) Rescan(from, to uint32) (relayed, skipped int, err error) {
+	items := make(chan *observer.CrossChainItem, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- relayer.btcOb.Rescan(from, to, items)
+		close(items)
+	}()
+
+	failed := 0
+	for item := range items {
+		imported, err := relayer.imported(item)
+		if err != nil {
+			log.Errorf("[BtcRelayer] rescan: failed to check if %s is imported: %v", item.Txid.String(), err)
+			failed++
+			continue
+		}
+		if imported {
+			log.Infof("[BtcRelayer] rescan: %s at height %d is already imported, skip it", item.Txid.String(),
+				item.Height)
+			skipped++
+			continue
+		}
+		txHash, err := relayer.importTransfer(item)
+		if err != nil {
+			log.Errorf("[BtcRelayer] rescan: failed to relay %s: %v", item.Txid.String(), err)
+			failed++
+			continue
+		}
+		executed, err := relayer.confirmImport(item, txHash)
+		if err != nil {
+			log.Errorf("[BtcRelayer] rescan: %v", err)
+			failed++
+			continue
+		}
+		if !executed {
+			log.Errorf("[BtcRelayer] rescan: import %s of %s not confirmed after %d rounds", txHash,
+				item.Txid.String(), ImportConfirmRounds)
+			failed++
+			continue
+		}
+		relayed++
+	}
+	if err = <-done; err != nil {
+		return relayed, skipped, err
+	}
+	if failed > 0 {
+		return relayed, skipped, fmt.Errorf("%d deposits failed to relay", failed)
+	}
+	return relayed, skipped, nil
+}
+
+// AlliaRescan captures the withdrawals in alliance blocks [from, to] again. The ones already
+// confirmed on btc are skipped and the rest are broadcast. Those failed to broadcast for now go
+// to the retry db for ReBroadcast, the ones rejected by the node are counted as failed. The
+// alliance cursor is not touched.
+func (relayer *BtcRelayer) AlliaRescan(from, to uint32) (queued, skipped int, err error) {
+	items := make(chan *observer.FromAllianceItem, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- relayer.alliaOb.Rescan(from, to, items)
+		close(items)
+	}()
+
+	failed := 0
+	for item := range items {
+		txb, err := hex.DecodeString(item.Tx)
+		if err != nil {
+			log.Errorf("[BtcRelayer] allia rescan: wrong hex tx %s: %v", item.Tx, err)
+			failed++
+			continue
+		}
+		mtx := wire.NewMsgTx(wire.TxVersion)
+		if err = mtx.BtcDecode(bytes.NewBuffer(txb), wire.ProtocolVersion, wire.LatestEncoding); err != nil {
+			log.Errorf("[BtcRelayer] allia rescan: failed to decode tx %s: %v", item.Tx, err)
+			failed++
+			continue
+		}
+		txid := mtx.TxHash().String()
+		confs, err := relayer.cli.GetTxConfirmations(txid)
+		if err != nil {
+			if _, ok := err.(observer.TxNotFoundErr); !ok {
+				log.Errorf("[BtcRelayer] allia rescan: failed to get confirmations of %s: %v", txid, err)
+				failed++
+				continue
+			}
+			// confirmed txs are only found with -txindex, the node tells when broadcasting
+			log.Warnf("[BtcRelayer] allia rescan: %s not found, broadcast it to check: %v", txid, err)
+		}
+		if confs > 0 {
+			log.Infof("[BtcRelayer] allia rescan: %s is confirmed %d times, skip it", txid, confs)
+			skipped++
+			continue
+		}
+		if _, err = relayer.cli.BroadcastTx(item.Tx); err != nil {
+			switch err.(type) {
+			case observer.TxInChainErr:
+				log.Infof("[BtcRelayer] allia rescan: %s is already confirmed, skip it", txid)
+				skipped++
+				continue
+			case observer.NeedToRetryErr, observer.NetErr:
+				log.Infof("[BtcRelayer] allia rescan: failed to broadcast %s and put it in retry db: %v", txid, err)
+				if err = relayer.retryDB.Put(item.Tx); err != nil {
+					log.Errorf("[BtcRelayer] allia rescan: failed to put tx %s in db: %v", txid, err)
+					failed++
+					continue
+				}
+			default:
+				log.Errorf("[BtcRelayer] allia rescan: %s is rejected: %v", txid, err)
+				failed++
+				continue
+			}
+		} else {
+			log.Infof("[BtcRelayer] allia rescan: broadcast tx: %s", txid)
+		}
+		queued++
+	}
+	if err = <-done; err != nil {
+		return queued, skipped, err
+	}
+	if failed > 0 {
+		return queued, skipped, fmt.Errorf("%d withdrawals failed to queue", failed)
+	}
+	return queued, skipped, nil
+}
+
+// importTransfer submits item to the alliance and keeps retrying while the alliance node is
+// unreachable. It returns the hash of the import.
+func (relayer *BtcRelayer) importTransfer(item *observer.CrossChainItem) (string, error) {
+	for {
+		txHash, err := relayer.allia.ImportOuterTransfer(observer.BTC_ID, item.Txid[:], item.Tx, uint32(item.Height),
+			item.Proof, relayer.account.Address[:], relayer.account)
+		if err == nil {
+			log.Infof("[BtcRelayer] %s sent to alliance : txid: %s, height: %d", txHash.ToHexString(),
+				item.Txid, item.Height)
+			return txHash.ToHexString(), nil
+		}
+		if _, ok := err.(client.PostErr); !ok {
+			return "", err
+		}
+		log.Errorf("[BtcRelayer] failed to relay and post err, retry after %d sec: %v", observer.SleepTime, err)
+		<-time.After(time.Second * observer.SleepTime)
 	}
 }
 
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/btcsuite/btcd/btcec"
 	"github.com/btcsuite/btcd/chaincfg"
@@ -12,7 +13,12 @@ import (
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 	"github.com/btcsuite/btcutil/base58"
+	"github.com/ontio/btcrelayer/db"
+	"github.com/ontio/btcrelayer/internal/testutil"
 	"github.com/ontio/btcrelayer/log"
+	"github.com/ontio/btcrelayer/observer"
+	sdk "github.com/ontio/multi-chain-go-sdk"
+	"io/ioutil"
 	"os"
 	"testing"
 	"time"
@@ -101,6 +107,294 @@ func TestBtcRelayer_ReBroadcast(t *testing.T) {
 	time.Sleep(3 * time.Minute)
 }
 
+func newTestRelayer(t *testing.T) (*BtcRelayer, *testutil.FakeBtcChain, func()) {
+	dir, err := ioutil.TempDir("", "btc_relayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := db.NewRetryDB(dir, 0, 1, 5000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	observer.SleepTime = 1
+	chain := testutil.NewFakeBtcChain(&chaincfg.RegressionNetParams)
+	btcOb, err := observer.NewBtcObserver(&observer.BtcObConfig{
+		NetType:            "regtest",
+		BtcObLoopWaitTime:  1,
+		BtcObConfirmations: 1,
+		WaitingCycle:       1,
+	}, chain, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allia := testutil.NewFakeAllianceChain()
+	validator, err := observer.NewWithdrawalValidator(chain, &observer.BtcObConfig{NetType: "regtest"}, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alliaOb, err := observer.NewAllianceObserver(allia, &observer.AllianceObConfig{
+		AlliaObLoopWaitTime: 1,
+		WatchingKey:         "btcTxToRelay",
+		NetType:             "regtest",
+		WaitingCycle:        1,
+	}, rdb, validator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &BtcRelayer{
+		btcOb:      btcOb,
+		alliaOb:    alliaOb,
+		account:    &sdk.Account{},
+		allia:      allia,
+		relaying:   make(chan *observer.CrossChainItem, 10),
+		collecting: make(chan *observer.FromAllianceItem, 10),
+		config:     &RelayerConfig{RetryDuration: 1},
+		cli:        chain,
+		retryDB:    rdb,
+	}, chain, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBtcRelayer_Broadcast(t *testing.T) {
+	r, chain, clean := newTestRelayer(t)
+	defer clean()
+	go r.Broadcast()
+
+	chain.Fail("BroadcastTx", 1, observer.NetErr{Err: errors.New("connection refused")})
+	r.collecting <- &observer.FromAllianceItem{Tx: txArr[0]}
+	chain.Fail("BroadcastTx", 1, observer.NeedToRetryErr{Err: errors.New("missing inputs")})
+	r.collecting <- &observer.FromAllianceItem{Tx: txArr[1]}
+
+	for i := 0; i < 50 && len(chain.Broadcasted()) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	txns := chain.Broadcasted()
+	if len(txns) != 1 {
+		t.Fatalf("one tx should be broadcasted, not %d", len(txns))
+	}
+	vals, err := r.retryDB.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 1 {
+		t.Fatal("one tx should be put into retry db")
+	}
+}
+
+func TestBtcRelayer_BroadcastOutbox(t *testing.T) {
+	r, chain, clean := newTestRelayer(t)
+	defer clean()
+	go r.Broadcast()
+
+	keys, err := r.retryDB.CommitAlliaBlock(1, txArr[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Fail("BroadcastTx", 1, observer.NetErr{Err: errors.New("connection refused")})
+	for i, key := range keys {
+		r.collecting <- &observer.FromAllianceItem{Tx: txArr[i], Key: key}
+	}
+	for i := 0; i < 50 && len(chain.Broadcasted()) < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(chain.Broadcasted()) != 2 {
+		t.Fatal("both txs should be broadcasted")
+	}
+	for i := 0; i < 10; i++ {
+		if outbox, _ := r.retryDB.GetAlliaOutbox(); len(outbox) == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("outbox should be empty after broadcasting")
+}
+
+func TestBtcRelayer_Relay(t *testing.T) {
+	r, chain, clean := newTestRelayer(t)
+	defer clean()
+	allia := r.allia.(*testutil.FakeAllianceChain)
+	allia.FailPost("ImportOuterTransfer", 1)
+	go r.Relay()
+
+	txid := chain.InjectDeposit(10000)
+	chain.Mine(1)
+	proof, _ := chain.GetProof([]string{txid.String()})
+	pb, _ := hex.DecodeString(proof)
+	r.relaying <- &observer.CrossChainItem{
+		Tx:     []byte{0x01},
+		Proof:  pb,
+		Height: 1,
+		Txid:   txid,
+	}
+
+	for i := 0; i < 50 && len(allia.Imported()) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	imported := allia.Imported()
+	if len(imported) != 1 || !bytes.Equal(imported[0].Txid, txid[:]) || imported[0].Height != 1 {
+		t.Fatal("deposit should be imported once after retry")
+	}
+}
+
+func TestBtcRelayer_RelayQueue(t *testing.T) {
+	r, chain, clean := newTestRelayer(t)
+	defer clean()
+	allia := r.allia.(*testutil.FakeAllianceChain)
+	allia.SetPending(true)
+	chain.Mine(5)
+	go r.Relay()
+	go r.BtcListen()
+
+	txid := chain.InjectDeposit(10000)
+	chain.Mine(1)
+	for i := 0; i < 50 && len(allia.Imported()) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(allia.Imported()) != 1 {
+		t.Fatal("deposit should be imported")
+	}
+	time.Sleep(2 * time.Second)
+	queued, err := r.retryDB.GetRelayQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 1 || queued[0].Txid != txid.String() {
+		t.Fatal("deposit should stay in queue until the import is confirmed")
+	}
+
+	// resumed from queue after restart
+	listen, err := observer.NewBtcObserver(&observer.BtcObConfig{
+		NetType:            "regtest",
+		BtcObLoopWaitTime:  1,
+		BtcObConfirmations: 1,
+	}, chain, r.retryDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relaying := make(chan *observer.CrossChainItem, 10)
+	go listen.Listen(relaying)
+	select {
+	case item := <-relaying:
+		if item.Txid != txid || !bytes.Equal(item.Key, queued[0].Key) || item.Payload == nil {
+			t.Fatalf("wrong deposit %s resumed from queue", item.Txid.String())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for deposit in queue")
+	}
+
+	allia.SetPending(false)
+	for i := 0; i < 50 && len(queued) > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+		queued, _ = r.retryDB.GetRelayQueue()
+	}
+	if len(queued) != 0 {
+		t.Fatal("deposit should leave queue once the import is confirmed")
+	}
+}
+
+func TestBtcRelayer_RelayReorg(t *testing.T) {
+	r, chain, clean := newTestRelayer(t)
+	defer clean()
+	allia := r.allia.(*testutil.FakeAllianceChain)
+	chain.Mine(5)
+	go r.BtcListen()
+
+	// relayed but not imported yet when its block is orphaned
+	orphan := chain.InjectDeposit(10000)
+	chain.Mine(1)
+	for i := 0; i < 50 && len(r.relaying) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	txid := chain.InjectDeposit(20000)
+	chain.Reorg(1, 2)
+	for i := 0; i < 50 && len(r.relaying) < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(r.relaying) != 2 {
+		t.Fatal("deposits of both blocks should be on the way")
+	}
+	go r.Relay()
+
+	for i := 0; i < 50 && len(allia.Imported()) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	time.Sleep(time.Second)
+	imported := allia.Imported()
+	if len(imported) != 1 || !bytes.Equal(imported[0].Txid, txid[:]) {
+		t.Fatalf("only %s should be imported, not the orphaned %s", txid.String(), orphan.String())
+	}
+}
+
+func TestBtcRelayer_RelayFailed(t *testing.T) {
+	r, chain, clean := newTestRelayer(t)
+	defer clean()
+	allia := r.allia.(*testutil.FakeAllianceChain)
+	allia.Fail("ImportOuterTransfer", 1, errors.New("refused"))
+	chain.Mine(5)
+	go r.Relay()
+	go r.BtcListen()
+
+	txid := chain.InjectDeposit(10000)
+	chain.Mine(1)
+	var failed []*db.FailedDeposit
+	for i := 0; i < 50 && len(failed) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+		failed, _ = r.FailedDeposits()
+	}
+	if len(failed) != 1 || failed[0].Txid != txid.String() || failed[0].Reason != "refused" {
+		t.Fatal("refused deposit should be kept as failed")
+	}
+	if queued, _ := r.retryDB.GetRelayQueue(); len(queued) != 0 {
+		t.Fatal("refused deposit should leave queue")
+	}
+
+	if n, err := r.ReplayFailed(); err != nil || n != 1 {
+		t.Fatalf("should replay 1 deposit, got %d: %v", n, err)
+	}
+	if queued, _ := r.retryDB.GetRelayQueue(); len(queued) != 1 || queued[0].Txid != txid.String() {
+		t.Fatal("replayed deposit should be back in queue")
+	}
+}
+
+func TestBtcRelayer_RelayDuplicates(t *testing.T) {
+	r, _, clean := newTestRelayer(t)
+	defer clean()
+	allia := r.allia.(*testutil.FakeAllianceChain)
+	go r.Relay()
+
+	// imported by another relayer
+	first := &observer.CrossChainItem{Tx: []byte{0x01}, Height: 1, Txid: chainhash.Hash{0x01}}
+	allia.ImportOuterTransfer(observer.BTC_ID, first.Txid[:], first.Tx, first.Height, nil, nil, nil)
+	r.relaying <- first
+	second := &observer.CrossChainItem{Tx: []byte{0x02}, Height: 2, Txid: chainhash.Hash{0x02}}
+	r.relaying <- second
+
+	var d *db.ImportedDeposit
+	for i := 0; i < 50 && d == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+		d, _ = r.retryDB.GetImportedDeposit(second.Txid.String())
+	}
+	imported := allia.Imported()
+	if len(imported) != 2 || d == nil || d.AllianceTxHash != imported[1].TxHash.ToHexString() {
+		t.Fatal("second deposit should be imported and indexed")
+	}
+	if d, _ = r.retryDB.GetImportedDeposit(first.Txid.String()); d == nil || d.AllianceTxHash != "" {
+		t.Fatal("deposit found on chain should be indexed")
+	}
+
+	// the index is checked before the chain
+	allia.Fail("GetStorage", 1, errors.New("should not be called"))
+	r.relaying <- second
+	for i := 0; i < 50 && r.Duplicates() < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if r.Duplicates() != 2 || len(allia.Imported()) != 2 {
+		t.Fatalf("duplicates should be skipped, got %d duplicates and %d imports", r.Duplicates(),
+			len(allia.Imported()))
+	}
+}
+
 func getPrivks() []*btcec.PrivateKey {
 	arr := []string {
 		"cTqbqa1YqCf4BaQTwYDGsPAB4VmWKUU67G5S1EtrHSWNRwY6QSag",
@@ -120,6 +414,116 @@ func getPrivks() []*btcec.PrivateKey {
 	return res
 }
 
+func TestBtcRelayer_Rescan(t *testing.T) {
+	r, chain, clean := newTestRelayer(t)
+	defer clean()
+	allia := r.allia.(*testutil.FakeAllianceChain)
+	chain.Mine(5)
+	go r.BtcListen()
+
+	chain.InjectDeposit(10000)
+	chain.Mine(1)
+	chain.InjectDeposit(20000)
+	chain.Mine(1)
+	for i := 0; i < 2; i++ {
+		select {
+		case item := <-r.relaying:
+			if i == 0 {
+				// only the first one reached the alliance
+				allia.ImportOuterTransfer(observer.BTC_ID, item.Txid[:], item.Tx, item.Height, item.Proof, nil, nil)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting for deposits")
+		}
+	}
+	for i := 0; i < 50 && r.retryDB.GetBtcHeight() < 7; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	relayed, skipped, err := r.Rescan(6, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relayed != 1 || skipped != 1 || len(allia.Imported()) != 2 {
+		t.Fatalf("should relay the missed one and skip the imported one, relayed %d, skipped %d", relayed, skipped)
+	}
+	missed := allia.Imported()[1]
+	txid, _ := chainhash.NewHash(missed.Txid)
+	d, err := r.retryDB.GetImportedDeposit(txid.String())
+	if err != nil || d == nil || d.AllianceTxHash != missed.TxHash.ToHexString() {
+		t.Fatal("deposit relayed by rescan should be indexed with its import")
+	}
+	if _, _, err = r.Rescan(6, 7); err != nil || len(allia.Imported()) != 2 {
+		t.Fatal("rescan should be idempotent")
+	}
+	if _, _, err = r.Rescan(7, 9); err == nil {
+		t.Fatal("should not rescan blocks the observer hasn't reached")
+	}
+	if r.retryDB.GetBtcHeight() != 7 {
+		t.Fatal("rescan should not touch the cursor")
+	}
+}
+
+func TestBtcRelayer_AlliaRescan(t *testing.T) {
+	r, chain, clean := newTestRelayer(t)
+	defer clean()
+	allia := r.allia.(*testutil.FakeAllianceChain)
+	txHex := func(mtx *wire.MsgTx) string {
+		var buf bytes.Buffer
+		mtx.BtcEncode(&buf, wire.ProtocolVersion, wire.LatestEncoding)
+		return hex.EncodeToString(buf.Bytes())
+	}
+	deposits := []chainhash.Hash{chain.InjectDeposit(10000), chain.InjectDeposit(20000)}
+	chain.Mine(1)
+	confirmed := chain.NewWithdrawalTx(deposits[0])
+	chain.InjectTx(confirmed)
+	chain.Mine(1)
+	missed := chain.NewWithdrawalTx(deposits[1])
+	allia.EmitWithdrawal(3, txHex(confirmed))
+	allia.EmitWithdrawal(4, txHex(missed))
+
+	queued, skipped, err := r.AlliaRescan(1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != 1 || skipped != 1 {
+		t.Fatalf("should skip the confirmed one, queued %d, skipped %d", queued, skipped)
+	}
+	if b := chain.Broadcasted(); len(b) != 1 || b[0].TxHash() != missed.TxHash() {
+		t.Fatal("the missed one should be broadcast")
+	}
+
+	chain.Fail("BroadcastTx", 1, observer.NeedToRetryErr{Err: errors.New("missing inputs")})
+	if _, _, err = r.AlliaRescan(4, 4); err != nil {
+		t.Fatal(err)
+	}
+	txs, err := r.retryDB.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 1 || txs[0] != txHex(missed) {
+		t.Fatal("tx failed to broadcast should go to retry db")
+	}
+
+	chain.Fail("BroadcastTx", 1, errors.New("bad-txns-inputs-missingorspent"))
+	if _, _, err = r.AlliaRescan(4, 4); err == nil {
+		t.Fatal("rejected tx should be reported")
+	}
+	if txs, _ = r.retryDB.GetAll(); len(txs) != 1 {
+		t.Fatal("rejected tx should not go to retry db")
+	}
+
+	// confirmed but unknown to a node without -txindex
+	chain.Fail("GetTxConfirmations", 1, observer.TxNotFoundErr{Err: errors.New("No such mempool transaction")})
+	chain.Fail("BroadcastTx", 1, observer.TxInChainErr{Err: errors.New("transaction already in block chain")})
+	if _, skipped, err = r.AlliaRescan(3, 3); err != nil || skipped != 1 {
+		t.Fatalf("tx already in chain should be skipped: %v", err)
+	}
+	if r.retryDB.GetAlliaHeight() != 0 {
+		t.Fatal("allia rescan should not touch the cursor")
+	}
+}
+
 func TestS(t *testing.T) {
 	redeem := "5521023ac710e73e1410718530b2686ce47f12fa3c470a9eb6085976b70b01c64c9f732102c9dc4d8f419e325bbef0fe039ed6feaf2079a2ef7b27336ddb79be2ea6e334bf2102eac939f2f0873894d8bf0ef2f8bbdd32e4290cbf9632b59dee743529c0af9e802103378b4a3854c88cca8bfed2558e9875a144521df4a75ab37a206049ccef12be692103495a81957ce65e3359c114e6c2fe9f97568be491e3f24d6fa66cc542e360cd662102d43e29299971e802160a92cfcd4037e8ae83fb8f6af138684bebdc5686f3b9db21031e415c04cbc9b81fbee6e04d8c902e8f61109a2c9883a959ba528c52698c055a57ae"
 	rb, _ := hex.DecodeString(redeem)